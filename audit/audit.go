@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SchemaVersion is increased on incompatible changes of Event
+const SchemaVersion = 1
+
+// Event types
+const (
+	LoginStarted     = "login_started"
+	CallbackVerified = "callback_verified"
+	CallbackFailed   = "callback_failed"
+	SessionResumed   = "session_resumed"
+	AccessDenied     = "access_denied"
+	CodeIssued       = "code_issued"
+	TokenIssued      = "token_issued"
+	TokenRefreshed   = "token_refreshed"
+	TokenFailed      = "token_failed"
+	TokenRevoked     = "token_revoked"
+	Logout           = "logout"
+)
+
+// Event is a single audit record, written as one line of JSON. All events of a login share
+// the correlation id, which is also the sid claim of the issued tokens.
+type Event struct {
+	Version       int       `json:"version"`
+	Time          time.Time `json:"time"`
+	Type          string    `json:"event"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	ClientID      string    `json:"client_id,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	Username      string    `json:"username,omitempty"`
+	IP            string    `json:"ip,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	GrantType     string    `json:"grant_type,omitempty"`
+	Scopes        []string  `json:"scopes,omitempty"`
+	// Admin is the admin who triggered the event through the admin api
+	Admin  string `json:"admin,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Logger writes audit events. A nil Logger discards all events.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+	// proxies are trusted to set X-Forwarded-For
+	proxies []netip.Prefix
+}
+
+// New creates a logger writing to w
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Open creates a logger writing to stdout, stderr or appending to the file at output
+func Open(output string) (*Logger, error) {
+	switch output {
+	case "", "stdout":
+		return New(os.Stdout), nil
+	case "stderr":
+		return New(os.Stderr), nil
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return New(f), nil
+}
+
+// TrustProxies makes the logger take the client address from X-Forwarded-For for requests from the
+// given proxies. Proxies are addresses or networks in CIDR notation.
+func (l *Logger) TrustProxies(proxies []string) error {
+	for _, p := range proxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(p)
+			if aerr != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		l.proxies = append(l.proxies, prefix.Masked())
+	}
+	return nil
+}
+
+// Log writes the event. The ip and user agent are taken from req, if it is not nil.
+func (l *Logger) Log(req *http.Request, e Event) {
+	if l == nil {
+		return
+	}
+	e.Version = SchemaVersion
+	e.Time = time.Now().UTC()
+	if req != nil {
+		e.IP = l.clientIP(req)
+		e.UserAgent = req.UserAgent()
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Str("event", e.Type).Msg("encoding audit event")
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(raw, '\n')); err != nil {
+		log.Error().Err(err).Str("event", e.Type).Msg("writing audit event")
+	}
+}
+
+// clientIP returns the remote address of the request. For requests from trusted proxies, it is the
+// right-most address of X-Forwarded-For which is not a trusted proxy, since clients can prepend
+// arbitrary addresses.
+func (l *Logger) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !l.trusted(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *Logger) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range l.proxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	l := New(nil)
+	if err := l.TrustProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"forged header without proxy", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"forged hop in front of the client", "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "192.0.2.1:1234", []string{"203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"multiple headers", "10.0.0.1:1234", []string{"198.51.100.1", "203.0.113.7,10.1.2.3"}, "203.0.113.7"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"ipv6 proxy", "[2001:db8::1]:1234", []string{"2001:db8:ffff::1, 2a00::1"}, "2a00::1"},
+		{"ipv4 mapped proxy", "[::ffff:10.0.0.1]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := l.clientIP(req); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTrustProxiesRejectsInvalidAddresses(t *testing.T) {
+	if err := New(nil).TrustProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid network accepted")
+	}
+	if err := New(nil).TrustProxies([]string{"proxy.example.com"}); err == nil {
+		t.Error("hostname accepted")
+	}
+}
@@ -0,0 +1,589 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/audit"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/policy"
+	"github.com/parkour-vienna/distrust/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin serves a JSON api to manage clients, sessions, tokens and signing keys of a running
+// oidc provider. Requests are authorized by one of the configured bearer tokens or by the
+// session of a discourse user in one of the admin groups.
+type Admin struct {
+	oidc     *OIDCProvider
+	root     string
+	tokens   []string
+	groups   []string
+	sessions *sessionCookies
+}
+
+type adminKey struct{}
+
+// adminClient is the representation of configured and registered clients in the admin api
+type adminClient struct {
+	ClientID   string `json:"client_id"`
+	Configured bool   `json:"configured"`
+	ClientMetadata
+	AllowGroups             []string   `json:"allow_groups,omitempty"`
+	DenyGroups              []string   `json:"deny_groups,omitempty"`
+	AllowRoles              []string   `json:"allow_roles,omitempty"`
+	DenyRoles               []string   `json:"deny_roles,omitempty"`
+	Policy                  string     `json:"policy,omitempty"`
+	Lifespans               *Lifespans `json:"lifespans,omitempty"`
+	EffectiveLifespans      *Lifespans `json:"effective_lifespans,omitempty"`
+	CreatedAt               int64      `json:"created_at,omitempty"`
+	UpdatedAt               int64      `json:"updated_at,omitempty"`
+	ClientSecret            string     `json:"client_secret,omitempty"`
+	RegistrationAccessToken string     `json:"registration_access_token,omitempty"`
+}
+
+type adminLogin struct {
+	SessionID string `json:"sid"`
+	ClientID  string `json:"client_id"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type adminToken struct {
+	RequestID   string   `json:"request_id"`
+	ClientID    string   `json:"client_id"`
+	Scopes      []string `json:"scopes"`
+	RequestedAt int64    `json:"requested_at"`
+	ExpiresAt   int64    `json:"expires_at,omitempty"`
+	Active      bool     `json:"active"`
+}
+
+type adminKeyInfo struct {
+	KeyID       string `json:"kid"`
+	Algorithm   string `json:"alg"`
+	State       string `json:"state"`
+	CreatedAt   int64  `json:"created_at"`
+	ActivatedAt int64  `json:"activated_at,omitempty"`
+	RetireAt    int64  `json:"retire_at,omitempty"`
+}
+
+// NewAdmin creates the admin api for the given provider, served at path. Admin sessions are sealed with
+// a key derived from secret. If groups is empty, only the bearer tokens are accepted.
+func NewAdmin(o *OIDCProvider, path string, secret []byte, tokens, groups []string) *Admin {
+	return &Admin{
+		oidc:     o,
+		root:     path,
+		tokens:   tokens,
+		groups:   groups,
+		sessions: newSessionCookies(secret, "distrust_admin", time.Hour),
+	}
+}
+
+func (a *Admin) RegisterHandlers(r chi.Router) {
+	r.Get("/login", a.loginEndpoint)
+	r.Get("/callback", a.callbackEndpoint)
+
+	r.Group(func(r chi.Router) {
+		r.Use(a.authorize)
+		r.Get("/clients", a.listClients)
+		r.Post("/clients", a.createClient)
+		r.Get("/clients/{id}", a.getClient)
+		r.Put("/clients/{id}", a.updateClient)
+		r.Delete("/clients/{id}", a.deleteClient)
+		r.Post("/clients/{id}/revoke", a.revokeClient)
+
+		r.Get("/users/{subject}/sessions", a.listSessions)
+		r.Get("/users/{subject}/tokens", a.listTokens)
+		r.Post("/users/{subject}/revoke", a.revokeUser)
+
+		r.Get("/keys", a.listKeys)
+		r.Post("/keys/rotate", a.rotateKeys)
+	})
+}
+
+// authorize only lets requests through which carry an admin token or the session of an admin
+func (a *Admin) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name, err := a.authenticate(req)
+		if err != nil {
+			log.Warn().Err(err).Str("path", req.URL.Path).Msg("unauthorized admin request")
+			writeAdminError(rw, http.StatusUnauthorized, errors.New("admin token or admin session required"))
+			return
+		}
+		if bearerToken(req) == "" {
+			if err := a.checkSameOrigin(req); err != nil {
+				log.Warn().Err(err).Str("admin", name).Str("path", req.URL.Path).Msg("cross site admin request")
+				writeAdminError(rw, http.StatusForbidden, err)
+				return
+			}
+		}
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), adminKey{}, name)))
+	})
+}
+
+// authenticate returns the name of the admin making the request
+func (a *Admin) authenticate(req *http.Request) (string, error) {
+	if token := bearerToken(req); token != "" {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return "token", nil
+			}
+		}
+		return "", errors.New("invalid admin token")
+	}
+	if len(a.groups) == 0 {
+		return "", errors.New("no admin token")
+	}
+	session, err := a.sessions.getSession(req)
+	if err != nil {
+		return "", err
+	}
+	if err := validateAccess(GroupRules{AllowGroups: a.groups}, session.Groups, nil); err != nil {
+		return "", err
+	}
+	return session.Username, nil
+}
+
+// checkSameOrigin rejects changes authorized by the session cookie which may have been sent by
+// another site. Forms can not send json, and browsers send the Origin of other requests.
+func (a *Admin) checkSameOrigin(req *http.Request) error {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return nil
+	}
+	if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return errors.New("changes require the content type application/json")
+	}
+	if origin := req.Header.Get("Origin"); origin != a.origin(req) {
+		return fmt.Errorf("origin %q is not allowed", origin)
+	}
+	return nil
+}
+
+func adminName(ctx context.Context) string {
+	name, _ := ctx.Value(adminKey{}).(string)
+	return name
+}
+
+// loginEndpoint signs in admins through discourse
+func (a *Admin) loginEndpoint(rw http.ResponseWriter, req *http.Request) {
+	if len(a.groups) == 0 {
+		writeAdminError(rw, http.StatusNotFound, errors.New("admin login is disabled"))
+		return
+	}
+	nonce := rand.Int()
+	if err := a.sessions.setState(rw, isSecure(req), nonce, a.root+"/clients"); err != nil {
+		log.Error().Err(err).Msg("storing admin login state")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("storing login state"))
+		return
+	}
+	callback := a.baseURL(req) + "/callback"
+	http.Redirect(rw, req, discourse.GenerateURL(a.oidc.discourseServer, callback, a.oidc.discourseSecret, nonce), http.StatusTemporaryRedirect)
+}
+
+func (a *Admin) callbackEndpoint(rw http.ResponseWriter, req *http.Request) {
+	state, err := a.sessions.getState(rw, req, isSecure(req))
+	if err != nil {
+		log.Warn().Err(err).Msg("restoring admin login state")
+		writeAdminError(rw, http.StatusBadRequest, errors.New("invalid session, please try again"))
+		return
+	}
+	values, err := discourse.ValidateResponse(req.URL.Query().Get("sso"), req.URL.Query().Get("sig"), a.oidc.discourseSecret, state.Nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("validating discourse response")
+		writeAdminError(rw, http.StatusBadRequest, errors.New("invalid discourse response"))
+		return
+	}
+	if err := validateAccess(GroupRules{AllowGroups: a.groups}, strings.Split(values.Get("groups"), ","), nil); err != nil {
+		log.Warn().Str("username", values.Get("username")).Msg("admin login denied")
+		writeAdminError(rw, http.StatusForbidden, err)
+		return
+	}
+	session, err := a.sessions.setSession(rw, isSecure(req), values)
+	if err != nil {
+		log.Error().Err(err).Msg("storing admin session")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("storing session"))
+		return
+	}
+	log.Info().Str("username", session.Username).Msg("admin logged in")
+	http.Redirect(rw, req, state.Redirect, http.StatusFound)
+}
+
+func (a *Admin) listClients(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	clients := []adminClient{}
+	for _, c := range a.oidc.store.ConfiguredClients(ctx) {
+		clients = append(clients, configuredClient(c, a.oidc.lifespans))
+	}
+	registered, err := a.oidc.store.ListRegisteredClients(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("listing registered clients")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("listing clients"))
+		return
+	}
+	for i := range registered {
+		c, err := registeredClient(&registered[i], a.oidc.lifespans)
+		if err != nil {
+			log.Warn().Err(err).Str("client", registered[i].ID).Msg("skipping client")
+			continue
+		}
+		clients = append(clients, *c)
+	}
+	writeJSON(rw, http.StatusOK, clients)
+}
+
+func (a *Admin) getClient(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	rc, err := a.oidc.store.GetRegisteredClient(ctx, id)
+	if errors.Is(err, fosite.ErrNotFound) {
+		client, err := a.oidc.store.GetClient(ctx, id)
+		if err != nil {
+			writeAdminError(rw, http.StatusNotFound, errors.New("unknown client"))
+			return
+		}
+		writeJSON(rw, http.StatusOK, configuredClient(client, a.oidc.lifespans))
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("client", id).Msg("loading registered client")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("loading client"))
+		return
+	}
+	c, err := registeredClient(rc, a.oidc.lifespans)
+	if err != nil {
+		writeAdminError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, c)
+}
+
+func (a *Admin) createClient(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var c adminClient
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, errors.New("malformed client"))
+		return
+	}
+	if err := c.ClientMetadata.validate(ctx); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	rc, secret, token, err := a.oidc.createClient(ctx, storedClient{
+		Metadata:   c.ClientMetadata,
+		GroupRules: GroupRules{AllowGroups: c.AllowGroups, DenyGroups: c.DenyGroups, AllowRoles: c.AllowRoles, DenyRoles: c.DenyRoles},
+		Policy:     c.Policy,
+		Lifespans:  c.Lifespans,
+	})
+	var re *registrationError
+	if errors.As(err, &re) {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("storing client")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("storing client"))
+		return
+	}
+	log.Info().Str("admin", adminName(ctx)).Str("client", rc.ID).Str("name", c.ClientName).Msg("created client")
+	created, err := registeredClient(rc, a.oidc.lifespans)
+	if err != nil {
+		writeAdminError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	created.ClientSecret = secret
+	created.RegistrationAccessToken = token
+	writeJSON(rw, http.StatusCreated, created)
+}
+
+func (a *Admin) updateClient(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	rc, sc, ok := a.registeredClient(rw, req)
+	if !ok {
+		return
+	}
+	var c adminClient
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, errors.New("malformed client"))
+		return
+	}
+	if err := c.ClientMetadata.validate(ctx); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if (c.TokenEndpointAuthMethod == "none") != (sc.Metadata.TokenEndpointAuthMethod == "none") {
+		writeAdminError(rw, http.StatusBadRequest, errors.New("a client can not switch between public and confidential"))
+		return
+	}
+	sc.Metadata = c.ClientMetadata
+	sc.GroupRules = GroupRules{AllowGroups: c.AllowGroups, DenyGroups: c.DenyGroups, AllowRoles: c.AllowRoles, DenyRoles: c.DenyRoles}
+	sc.Policy = c.Policy
+	sc.Lifespans = c.Lifespans
+	err := a.oidc.updateClient(ctx, rc, *sc)
+	var re *registrationError
+	if errors.As(err, &re) {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("client", rc.ID).Msg("updating client")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("storing client"))
+		return
+	}
+	log.Info().Str("admin", adminName(ctx)).Str("client", rc.ID).Msg("updated client")
+	updated, err := registeredClient(rc, a.oidc.lifespans)
+	if err != nil {
+		writeAdminError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, updated)
+}
+
+func (a *Admin) deleteClient(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	rc, _, ok := a.registeredClient(rw, req)
+	if !ok {
+		return
+	}
+	if err := a.oidc.deleteRegisteredClient(ctx, rc.ID); err != nil {
+		log.Error().Err(err).Str("client", rc.ID).Msg("deleting client")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("deleting client"))
+		return
+	}
+	log.Info().Str("admin", adminName(ctx)).Str("client", rc.ID).Msg("deleted client")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// registeredClient loads the client of the request. Configured clients can not be changed at runtime.
+func (a *Admin) registeredClient(rw http.ResponseWriter, req *http.Request) (*storage.RegisteredClient, *storedClient, bool) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	rc, err := a.oidc.store.GetRegisteredClient(ctx, id)
+	if errors.Is(err, fosite.ErrNotFound) {
+		if _, err := a.oidc.store.GetClient(ctx, id); err == nil {
+			writeAdminError(rw, http.StatusConflict, errors.New("configured clients can only be changed in the config file"))
+			return nil, nil, false
+		}
+		writeAdminError(rw, http.StatusNotFound, errors.New("unknown client"))
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("client", id).Msg("loading registered client")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("loading client"))
+		return nil, nil, false
+	}
+	var sc storedClient
+	if err := json.Unmarshal([]byte(rc.Data), &sc); err != nil {
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("decoding client"))
+		return nil, nil, false
+	}
+	return rc, &sc, true
+}
+
+func (a *Admin) revokeClient(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	if _, err := a.oidc.store.GetClient(ctx, id); err != nil {
+		writeAdminError(rw, http.StatusNotFound, errors.New("unknown client"))
+		return
+	}
+	if err := a.oidc.store.RevokeClient(ctx, id); err != nil {
+		log.Error().Err(err).Str("client", id).Msg("revoking client tokens")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("revoking tokens"))
+		return
+	}
+	log.Info().Str("admin", adminName(ctx)).Str("client", id).Msg("revoked all tokens of client")
+	a.oidc.audit.Log(req, audit.Event{Type: audit.TokenRevoked, ClientID: id, Admin: adminName(ctx), Reason: "admin revoked all tokens of client"})
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listSessions(rw http.ResponseWriter, req *http.Request) {
+	logins, err := a.oidc.store.ListLogins(req.Context(), chi.URLParam(req, "subject"))
+	if err != nil {
+		log.Error().Err(err).Msg("listing logins")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("listing sessions"))
+		return
+	}
+	sessions := make([]adminLogin, 0, len(logins))
+	for _, l := range logins {
+		sessions = append(sessions, adminLogin{
+			SessionID: l.SessionID,
+			ClientID:  l.ClientID,
+			CreatedAt: l.CreatedAt.Unix(),
+			ExpiresAt: l.ExpiresAt.Unix(),
+		})
+	}
+	writeJSON(rw, http.StatusOK, sessions)
+}
+
+func (a *Admin) listTokens(rw http.ResponseWriter, req *http.Request) {
+	infos, err := a.oidc.store.ListRefreshTokens(req.Context(), chi.URLParam(req, "subject"))
+	if err != nil {
+		log.Error().Err(err).Msg("listing refresh tokens")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("listing tokens"))
+		return
+	}
+	tokens := make([]adminToken, 0, len(infos))
+	for _, t := range infos {
+		tokens = append(tokens, adminToken{
+			RequestID:   t.RequestID,
+			ClientID:    t.ClientID,
+			Scopes:      t.Scopes,
+			RequestedAt: t.RequestedAt.Unix(),
+			ExpiresAt:   unixOrZero(t.ExpiresAt),
+			Active:      t.Active,
+		})
+	}
+	writeJSON(rw, http.StatusOK, tokens)
+}
+
+// revokeUser revokes all tokens of the user and notifies the clients they signed into
+func (a *Admin) revokeUser(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	subject := chi.URLParam(req, "subject")
+	if err := a.oidc.store.RevokeSubject(ctx, subject); err != nil {
+		log.Error().Err(err).Str("subject", subject).Msg("revoking tokens")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("revoking tokens"))
+		return
+	}
+	a.oidc.backchannelLogout(ctx, subject)
+	log.Info().Str("admin", adminName(ctx)).Str("subject", subject).Msg("revoked all tokens of user")
+	a.oidc.audit.Log(req, audit.Event{Type: audit.TokenRevoked, Subject: subject, Admin: adminName(ctx), Reason: "admin revoked all tokens of user"})
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listKeys(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, a.oidc.keys.info())
+}
+
+func (a *Admin) rotateKeys(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if err := a.oidc.keys.Rotate(ctx); err != nil {
+		log.Error().Err(err).Msg("rotating signing keys")
+		writeAdminError(rw, http.StatusInternalServerError, errors.New("rotating signing keys"))
+		return
+	}
+	log.Info().Str("admin", adminName(ctx)).Msg("rotated signing keys")
+	writeJSON(rw, http.StatusOK, a.oidc.keys.info())
+}
+
+func (a *Admin) baseURL(req *http.Request) string {
+	return a.origin(req) + a.root
+}
+
+// origin returns the origin under which the admin api is served
+func (a *Admin) origin(req *http.Request) string {
+	scheme := "http"
+	if isSecure(req) {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+func configuredClient(c fosite.Client, lifespans Lifespans) adminClient {
+	ac := adminClient{
+		ClientID:   c.GetID(),
+		Configured: true,
+		ClientMetadata: ClientMetadata{
+			RedirectURIs:            c.GetRedirectURIs(),
+			GrantTypes:              c.GetGrantTypes(),
+			ResponseTypes:           c.GetResponseTypes(),
+			Scope:                   strings.Join(c.GetScopes(), " "),
+			TokenEndpointAuthMethod: "client_secret_basic",
+		},
+	}
+	if c.IsPublic() {
+		ac.TokenEndpointAuthMethod = "none"
+	}
+	if dc, ok := c.(*DistrustClient); ok {
+		ac.TokenEndpointAuthMethod = dc.GetTokenEndpointAuthMethod()
+		ac.PostLogoutRedirectURIs = dc.PostLogoutRedirectURIs
+		ac.BackchannelLogoutURI = dc.BackchannelLogoutURI
+		ac.AllowGroups = dc.AllowGroups
+		ac.DenyGroups = dc.DenyGroups
+		ac.AllowRoles = dc.AllowRoles
+		ac.DenyRoles = dc.DenyRoles
+		if dc.Policy != nil {
+			ac.Policy = dc.Policy.String()
+		}
+		if dc.Lifespans != (Lifespans{}) {
+			ac.Lifespans = &dc.Lifespans
+		}
+		lifespans = lifespans.merge(dc.Lifespans)
+	}
+	ac.EffectiveLifespans = &lifespans
+	return ac
+}
+
+func registeredClient(rc *storage.RegisteredClient, lifespans Lifespans) (*adminClient, error) {
+	var sc storedClient
+	if err := json.Unmarshal([]byte(rc.Data), &sc); err != nil {
+		return nil, errors.New("decoding client")
+	}
+	if sc.Lifespans != nil {
+		lifespans = lifespans.merge(*sc.Lifespans)
+	}
+	return &adminClient{
+		ClientID:           rc.ID,
+		ClientMetadata:     sc.Metadata,
+		AllowGroups:        sc.AllowGroups,
+		DenyGroups:         sc.DenyGroups,
+		AllowRoles:         sc.AllowRoles,
+		DenyRoles:          sc.DenyRoles,
+		Policy:             sc.Policy,
+		Lifespans:          sc.Lifespans,
+		EffectiveLifespans: &lifespans,
+		CreatedAt:          rc.CreatedAt.Unix(),
+		UpdatedAt:          rc.UpdatedAt.Unix(),
+	}, nil
+}
+
+// validate checks that the policy of the client compiles and its lifespans are valid
+func (c *adminClient) validate() error {
+	if c.Policy != "" {
+		if _, err := policy.Compile(c.Policy); err != nil {
+			return fmt.Errorf("invalid policy: %w", err)
+		}
+	}
+	if c.Lifespans != nil {
+		if err := c.Lifespans.Validate(); err != nil {
+			return fmt.Errorf("invalid lifespans: %w", err)
+		}
+	}
+	return nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeAdminError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ory/fosite"
+)
+
+const testAdminToken = "some-admin-token"
+
+// newTestAdmin serves the admin api at /admin, admins log in through the discourse stub as user
+func newTestAdmin(t *testing.T, user url.Values) (*http.Client, *httptest.Server) {
+	t.Helper()
+	disc := newDiscourseStub(t, user)
+	o, _ := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "test",
+			Public:        true,
+			RedirectURIs:  []string{"https://rp.example.com/cb"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scopes:        []string{"openid"},
+		}},
+	})
+	r := chi.NewRouter()
+	r.Route("/admin", NewAdmin(o, "/admin", []byte("some-exactly-32-byte-long-secret"), []string{testAdminToken}, []string{"admins"}).RegisterHandlers)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return newBrowser(t, srv, disc), srv
+}
+
+// adminRequest sends body as json and decodes the response into v
+func adminRequest(t *testing.T, client *http.Client, method, url string, header http.Header, body, v interface{}) int {
+	t.Helper()
+	var raw []byte
+	if body != nil {
+		raw, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewReader(raw))
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		_ = json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+var testAdminClient = map[string]interface{}{
+	"client_name":    "app",
+	"redirect_uris":  []string{"https://app.example.com/cb"},
+	"grant_types":    []string{"authorization_code"},
+	"response_types": []string{"code"},
+	"scope":          "openid",
+	"allow_groups":   []string{"team"},
+}
+
+func TestAdminToken(t *testing.T) {
+	_, srv := newTestAdmin(t, nil)
+	client := http.DefaultClient
+	bearer := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+
+	if status := adminRequest(t, client, http.MethodGet, srv.URL+"/admin/clients", nil, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("request without token: got %d", status)
+	}
+	wrong := http.Header{"Authorization": {"Bearer wrong-token"}}
+	if status := adminRequest(t, client, http.MethodGet, srv.URL+"/admin/clients", wrong, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("request with wrong token: got %d", status)
+	}
+
+	var clients []adminClient
+	if status := adminRequest(t, client, http.MethodGet, srv.URL+"/admin/clients", bearer, nil, &clients); status != http.StatusOK {
+		t.Fatalf("listing clients: got %d", status)
+	}
+	if len(clients) != 1 || clients[0].ClientID != "test" || !clients[0].Configured {
+		t.Errorf("got clients %+v, want the configured client", clients)
+	}
+
+	// token requests are not sent by browsers, so they need neither json nor an origin
+	var created adminClient
+	if status := adminRequest(t, client, http.MethodPost, srv.URL+"/admin/clients", bearer, testAdminClient, &created); status != http.StatusCreated {
+		t.Fatalf("creating client: got %d", status)
+	}
+	if created.ClientID == "" || created.ClientSecret == "" || created.Configured {
+		t.Fatalf("got created client %+v", created)
+	}
+	clientURL := srv.URL + "/admin/clients/" + created.ClientID
+
+	var got adminClient
+	if status := adminRequest(t, client, http.MethodGet, clientURL, bearer, nil, &got); status != http.StatusOK {
+		t.Fatalf("getting client: got %d", status)
+	}
+	if got.ClientName != "app" || got.ClientSecret != "" || len(got.AllowGroups) != 1 {
+		t.Errorf("got client %+v", got)
+	}
+
+	update := map[string]interface{}{}
+	for k, v := range testAdminClient {
+		update[k] = v
+	}
+	update["client_name"] = "renamed"
+	if status := adminRequest(t, client, http.MethodPut, clientURL, bearer, update, &got); status != http.StatusOK || got.ClientName != "renamed" {
+		t.Errorf("updating client: got %d %+v", status, got)
+	}
+	update["policy"] = "hour"
+	if status := adminRequest(t, client, http.MethodPut, clientURL, bearer, update, nil); status != http.StatusBadRequest {
+		t.Errorf("update with invalid policy: got %d", status)
+	}
+	if status := adminRequest(t, client, http.MethodPut, srv.URL+"/admin/clients/test", bearer, testAdminClient, nil); status != http.StatusConflict {
+		t.Errorf("updating configured client: got %d", status)
+	}
+
+	if status := adminRequest(t, client, http.MethodPost, clientURL+"/revoke", bearer, nil, nil); status != http.StatusNoContent {
+		t.Errorf("revoking client: got %d", status)
+	}
+	if status := adminRequest(t, client, http.MethodPost, srv.URL+"/admin/clients/unknown/revoke", bearer, nil, nil); status != http.StatusNotFound {
+		t.Errorf("revoking unknown client: got %d", status)
+	}
+	if status := adminRequest(t, client, http.MethodDelete, clientURL, bearer, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("deleting client: got %d", status)
+	}
+	if status := adminRequest(t, client, http.MethodGet, clientURL, bearer, nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleted client: got %d", status)
+	}
+	if status := adminRequest(t, client, http.MethodDelete, srv.URL+"/admin/clients/test", bearer, nil, nil); status != http.StatusConflict {
+		t.Errorf("deleting configured client: got %d", status)
+	}
+
+	var keys []adminKeyInfo
+	if status := adminRequest(t, client, http.MethodPost, srv.URL+"/admin/keys/rotate", bearer, nil, &keys); status != http.StatusOK || len(keys) < 2 {
+		t.Errorf("rotating keys: got %d %+v", status, keys)
+	}
+}
+
+func TestAdminSession(t *testing.T) {
+	user := url.Values{"external_id": {"1"}, "username": {"root"}, "groups": {"team,admins"}}
+	browser, srv := newTestAdmin(t, user)
+
+	resp, err := browser.Get(srv.URL + "/admin/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/admin/clients" {
+		t.Fatalf("admin login ended with %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	sameOrigin := http.Header{"Content-Type": {"application/json"}, "Origin": {srv.URL}}
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"form", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}, "Origin": {srv.URL}}, http.StatusForbidden},
+		{"text", http.Header{"Content-Type": {"text/plain"}, "Origin": {srv.URL}}, http.StatusForbidden},
+		{"without origin", http.Header{"Content-Type": {"application/json"}}, http.StatusForbidden},
+		{"other origin", http.Header{"Content-Type": {"application/json"}, "Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+		{"null origin", http.Header{"Content-Type": {"application/json"}, "Origin": {"null"}}, http.StatusForbidden},
+		{"same origin", http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Origin": {srv.URL}}, http.StatusCreated},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := adminRequest(t, browser, http.MethodPost, srv.URL+"/admin/clients", tc.header, testAdminClient, nil); status != tc.status {
+				t.Errorf("creating client: got %d, want %d", status, tc.status)
+			}
+		})
+	}
+	for _, path := range []string{"/admin/clients/test/revoke", "/admin/users/1/revoke", "/admin/keys/rotate"} {
+		if status := adminRequest(t, browser, http.MethodPost, srv.URL+path, nil, nil, nil); status != http.StatusForbidden {
+			t.Errorf("%s without origin: got %d", path, status)
+		}
+	}
+	if status := adminRequest(t, browser, http.MethodPost, srv.URL+"/admin/keys/rotate", sameOrigin, nil, nil); status != http.StatusOK {
+		t.Errorf("rotating keys: got %d", status)
+	}
+	// reading does not change anything
+	if status := adminRequest(t, browser, http.MethodGet, srv.URL+"/admin/users/1/sessions", nil, nil, nil); status != http.StatusOK {
+		t.Errorf("listing sessions: got %d", status)
+	}
+}
+
+func TestAdminSessionOfNonAdmin(t *testing.T) {
+	user := url.Values{"external_id": {"2"}, "username": {"alice"}, "groups": {"team"}}
+	browser, srv := newTestAdmin(t, user)
+
+	resp, err := browser.Get(srv.URL + "/admin/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("login of a non admin ended with %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+	if status := adminRequest(t, browser, http.MethodGet, srv.URL+"/admin/clients", nil, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("listing clients as non admin: got %d", status)
+	}
+}
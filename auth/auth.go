@@ -1,48 +1,103 @@
 package auth
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"errors"
+	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
 	"github.com/ory/fosite/handler/openid"
-	"github.com/ory/fosite/storage"
 	"github.com/ory/fosite/token/jwt"
+	"github.com/parkour-vienna/distrust/audit"
 	"github.com/parkour-vienna/distrust/cryptutils"
 	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/policy"
+	"github.com/parkour-vienna/distrust/storage"
 	"github.com/rs/zerolog/log"
 )
 
 type OIDCProvider struct {
 	oauth2          fosite.OAuth2Provider
-	inflight        map[uuid.UUID]*InFlightRequest
+	config          *fosite.Config
+	cookieKey       []byte
+	ssoKey          []byte
+	ssoLifetime     time.Duration
 	root            string
 	discourseServer string
 	discourseSecret string
-	privateKey      *rsa.PrivateKey
+	discourseAPI    *discourse.APIClient
+	discourseLogout bool
+	discourseResync bool
+	discoursePrompt bool
+	store           storage.Storage
+	keys            *KeySet
+	signer          *keySigner
+	registration    registrationOptions
+	pkce            PKCEPolicy
+	claims          ClaimMappings
+	roles           RoleMappings
+	lifespans       Lifespans
+	audit           *audit.Logger
+	// deliveries tracks the back-channel logouts sent in the background
+	deliveries sync.WaitGroup
 }
 
 type DistrustClient struct {
 	fosite.DefaultClient
-	AllowGroups []string
-	DenyGroups  []string
+	GroupRules
+	PostLogoutRedirectURIs []string
+	BackchannelLogoutURI   string
+	// TokenEndpointAuthMethod is one of client_secret_basic, client_secret_post or none for public clients
+	TokenEndpointAuthMethod string
+	// PKCE overrides the global pkce policy for this client
+	PKCE PKCEPolicy
+	// Claims override the global claim mappings for this client
+	Claims ClaimMappings
+	// Roles override the global role mappings for this client
+	Roles RoleMappings
+	// Policy additionally restricts access to users for which it evaluates to true
+	Policy *policy.Policy
+	// Lifespans override the global lifespans for this client
+	Lifespans Lifespans
+	// registered is set for clients registered at runtime
+	registered bool
 }
 
-type InFlightRequest struct {
-	Nonce int
-	Ar    fosite.AuthorizeRequester
+// GroupRules restrict access to users in certain discourse groups or with certain roles.
+// If AllowGroups or AllowRoles is set, DenyGroups and DenyRoles are ignored.
+type GroupRules struct {
+	AllowGroups []string
+	DenyGroups  []string
+	AllowRoles  []string
+	DenyRoles   []string
 }
 
 type oidcOptions struct {
-	privateKey *rsa.PrivateKey
-	secret     []byte
+	privateKey  crypto.Signer
+	secret      []byte
+	keySpec     cryptutils.KeySpec
+	keyRotation time.Duration
+
+	discourseAPI    *discourse.APIClient
+	discourseLogout bool
+	discourseResync bool
+	discoursePrompt bool
+
+	registration registrationOptions
+	pkce         PKCEPolicy
+	claims       ClaimMappings
+	roles        RoleMappings
+	lifespans    Lifespans
+	audit        *audit.Logger
+	ssoLifetime  time.Duration
 }
 
 type funcOIDCOption struct {
@@ -57,9 +112,7 @@ type OIDCOption interface {
 	apply(do *oidcOptions)
 }
 
-func NewOIDC(path string, disc discourse.SSOConfig, clients map[string]fosite.Client, opts ...OIDCOption) *OIDCProvider {
-	s := storage.NewMemoryStore()
-	s.Clients = clients
+func NewOIDC(path string, disc discourse.SSOConfig, s storage.Storage, opts ...OIDCOption) (*OIDCProvider, error) {
 	oopts := oidcOptions{}
 	for _, opt := range opts {
 		opt.apply(&oopts)
@@ -72,26 +125,105 @@ func NewOIDC(path string, disc discourse.SSOConfig, clients map[string]fosite.Cl
 		oopts.secret = secret
 	}
 	if oopts.privateKey == nil {
-		log.Warn().Msg("no private key specified in oidc provider. Your tokens will be invalid on restart")
-		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
-		oopts.privateKey = priv
+		log.Info().Msg("no private key specified in oidc provider. Signing keys are generated and kept in the storage")
+	}
+
+	lifespans := DefaultLifespans.merge(oopts.lifespans)
+	if err := lifespans.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid lifespans: %w", err)
+	}
+
+	s.SetClientDecoder(decodeClient)
+	keys := NewKeySet(s, oopts.secret, oopts.keySpec, oopts.keyRotation)
+	if err := keys.init(context.Background(), oopts.privateKey); err != nil {
+		return nil, fmt.Errorf("initializing signing keys: %w", err)
 	}
+	go keys.run(context.Background())
 
+	signer := &keySigner{keys: keys}
 	config := &fosite.Config{
-		AccessTokenLifespan: time.Minute * 30,
-		GlobalSecret: oopts.secret,
+		AccessTokenLifespan:  lifespans.AccessToken,
+		IDTokenLifespan:      lifespans.IDToken,
+		RefreshTokenLifespan: lifespans.RefreshToken,
+		// shorter lifespans of authorization codes are enforced by the token endpoint
+		AuthorizeCodeLifespan: maxAuthorizeCodeLifespan,
+		GlobalSecret:          oopts.secret,
+		// pkce policies are enforced per client in the authorize endpoint, which also
+		// rejects plain challenges for clients only allowing S256
+		EnforcePKCEForPublicClients:    true,
+		EnablePKCEPlainChallengeMethod: true,
 	}
 	return &OIDCProvider{
-		oauth2:          compose.ComposeAllEnabled(config, s, oopts.privateKey),
-		inflight:        map[uuid.UUID]*InFlightRequest{},
+		oauth2:          composeProvider(config, rotationStore{s}, signer),
+		config:          config,
+		cookieKey:       cryptutils.DeriveKey(oopts.secret, "distrust inflight request"),
+		ssoKey:          cryptutils.DeriveKey(oopts.secret, "distrust sso session"),
+		ssoLifetime:     oopts.ssoLifetime,
 		root:            path,
-		privateKey:      oopts.privateKey,
+		store:           s,
+		keys:            keys,
+		signer:          signer,
 		discourseServer: disc.Server,
 		discourseSecret: disc.Secret,
-	}
+		discourseAPI:    oopts.discourseAPI,
+		discourseLogout: oopts.discourseLogout,
+		discourseResync: oopts.discourseResync,
+		discoursePrompt: oopts.discoursePrompt,
+		registration:    oopts.registration,
+		pkce:            oopts.pkce,
+		claims:          oopts.claims,
+		roles:           oopts.roles,
+		lifespans:       lifespans,
+		audit:           oopts.audit,
+	}, nil
 }
 
-func WithPrivateKey(p *rsa.PrivateKey) OIDCOption {
+// CheckStorage is a readiness check of the storage backend
+func (o *OIDCProvider) CheckStorage(ctx context.Context) error {
+	return o.store.Ping(ctx)
+}
+
+// CheckKeys is a readiness check that a signing key is loaded
+func (o *OIDCProvider) CheckKeys(ctx context.Context) error {
+	_, err := o.keys.SigningKey(ctx)
+	return err
+}
+
+// composeProvider enables the same handlers as compose.ComposeAllEnabled,
+// but signs with the given signer so key rotations take effect immediately
+func composeProvider(config *fosite.Config, s storage.Storage, signer jwt.Signer) fosite.OAuth2Provider {
+	return compose.Compose(
+		config,
+		s,
+		&compose.CommonStrategy{
+			CoreStrategy: compose.NewOAuth2HMACStrategy(config),
+			OpenIDConnectTokenStrategy: &openid.DefaultStrategy{
+				Signer: signer,
+				Config: config,
+			},
+			Signer: signer,
+		},
+		compose.OAuth2AuthorizeExplicitFactory,
+		compose.OAuth2AuthorizeImplicitFactory,
+		compose.OAuth2ClientCredentialsGrantFactory,
+		compose.OAuth2RefreshTokenGrantFactory,
+		compose.OAuth2ResourceOwnerPasswordCredentialsFactory,
+		compose.RFC7523AssertionGrantFactory,
+
+		compose.OpenIDConnectExplicitFactory,
+		compose.OpenIDConnectImplicitFactory,
+		compose.OpenIDConnectHybridFactory,
+		compose.OpenIDConnectRefreshFactory,
+
+		compose.OAuth2TokenIntrospectionFactory,
+		compose.OAuth2TokenRevocationFactory,
+
+		compose.OAuth2PKCEFactory,
+		compose.PushedAuthorizeHandlerFactory,
+	)
+}
+
+func WithPrivateKey(p crypto.Signer) OIDCOption {
 	return &funcOIDCOption{
 		func(o *oidcOptions) {
 			o.privateKey = p
@@ -99,6 +231,131 @@ func WithPrivateKey(p *rsa.PrivateKey) OIDCOption {
 	}
 }
 
+// WithKeySpec sets the type of keys generated on rotation
+func WithKeySpec(spec cryptutils.KeySpec) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.keySpec = spec
+		},
+	}
+}
+
+// WithKeyRotation enables scheduled rotation of the signing keys
+func WithKeyRotation(interval time.Duration) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.keyRotation = interval
+		},
+	}
+}
+
+// WithDiscourseAPI sets the client used for calls to the discourse admin api
+func WithDiscourseAPI(c *discourse.APIClient) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.discourseAPI = c
+		},
+	}
+}
+
+// WithDiscourseLogout ends the discourse sessions of users logging out of distrust.
+// It requires the discourse api to be configured.
+func WithDiscourseLogout(enabled bool) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.discourseLogout = enabled
+		},
+	}
+}
+
+// WithDiscourseResync reloads the user from discourse when tokens are refreshed, so changes of
+// their groups and suspensions take effect. It requires the discourse api to be configured.
+func WithDiscourseResync(enabled bool) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.discourseResync = enabled
+		},
+	}
+}
+
+// WithDiscoursePromptNone sends authorize requests with prompt=none to discourse if the browser has
+// no sso session, so users who are logged in to discourse are logged in without interaction
+func WithDiscoursePromptNone(enabled bool) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.discoursePrompt = enabled
+		},
+	}
+}
+
+// WithRegistration enables dynamic client registration. Unless open is set, clients
+// need to present one of the initial access tokens to register.
+func WithRegistration(open bool, initialAccessTokens []string) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.registration = registrationOptions{
+				open:                open,
+				initialAccessTokens: initialAccessTokens,
+			}
+		},
+	}
+}
+
+// WithPKCE sets the default pkce policy of all clients
+func WithPKCE(policy PKCEPolicy) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.pkce = policy
+		},
+	}
+}
+
+// WithClaims sets the claim mappings applied for all clients
+func WithClaims(mappings ClaimMappings) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.claims = mappings
+		},
+	}
+}
+
+// WithRoles sets the role mappings applied for all clients
+func WithRoles(mappings RoleMappings) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.roles = mappings
+		},
+	}
+}
+
+// WithLifespans sets the lifespans of tokens and logins, unset lifespans use DefaultLifespans
+func WithLifespans(lifespans Lifespans) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.lifespans = lifespans
+		},
+	}
+}
+
+// WithAudit writes audit events of logins, tokens and logouts to l
+func WithAudit(l *audit.Logger) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.audit = l
+		},
+	}
+}
+
+// WithSSOSession keeps browsers logged in for lifetime, so authorize requests of
+// users who already logged in are answered without redirecting to discourse
+func WithSSOSession(lifetime time.Duration) OIDCOption {
+	return &funcOIDCOption{
+		func(o *oidcOptions) {
+			o.ssoLifetime = lifetime
+		},
+	}
+}
+
 func WithSecret(s []byte) OIDCOption {
 	if len(s) != 32 {
 		log.Err(errors.New("invalid secret length")).Str("secret", string(s)).Msg("secrets must be exactly 32 bytes long. OIDC might not work")
@@ -121,33 +378,59 @@ func (o *OIDCProvider) RegisterHandlers(r chi.Router) {
 	// revoke tokens
 	r.HandleFunc("/revoke", o.revokeEndpoint)
 
+	// end the session
+	r.HandleFunc("/logout", o.logoutEndpoint)
+
+	// dynamic client registration
+	if o.registration.enabled() {
+		r.Post("/register", o.registerEndpoint)
+		r.HandleFunc("/register/{id}", o.registeredClientEndpoint)
+	}
+
 	r.Get("/.well-known/openid-configuration", o.informationEndpoint)
 	r.HandleFunc("/certs", o.certsEndpoint)
 }
 
+// userSession creates the session of the user described by values for the request. Only the
+// claims of the granted scopes are released.
+func (o *OIDCProvider) userSession(aroot string, ar fosite.Requester, values url.Values, roles []string) *openid.DefaultSession {
+	session := o.newSession(aroot, values)
+	session.Claims.Extra["roles"] = roles
+	mappings := o.claimMappings(ar.GetClient())
+	mappings.apply(session.Claims.Extra, values)
+	session.Claims.Extra = releaseClaims(session.Claims.Extra, ar.GetGrantedScopes(), mappings)
+	return session
+}
+
+// newSession creates a session for the user in values. Without values, an empty session is returned
+// which is hydrated from the storage.
 func (o *OIDCProvider) newSession(aroot string, values url.Values) *openid.DefaultSession {
+	extra := map[string]interface{}{}
+	if values != nil {
+		extra = map[string]interface{}{
+			"email":              values.Get("email"),
+			"email_verified":     true,
+			"picture":            values.Get("avatar_url"),
+			"name":               values.Get("name"),
+			"groups":             strings.Split(values.Get("groups"), ","),
+			"preferred_username": values.Get("username"),
+		}
+	}
 	return &openid.DefaultSession{
+		Subject:  values.Get("external_id"),
+		Username: values.Get("username"),
 		Claims: &jwt.IDTokenClaims{
 			Issuer:      aroot,
 			Subject:     values.Get("external_id"),
 			Audience:    []string{},
-			ExpiresAt:   time.Now().Add(time.Hour * 6),
 			IssuedAt:    time.Now(),
 			RequestedAt: time.Now(),
 			AuthTime:    time.Now(),
-			Extra: map[string]interface{}{
-				"email":              values.Get("email"),
-				"email_verified":     true,
-				"picture":            values.Get("avatar_url"),
-				"name":               values.Get("name"),
-				"groups":             strings.Split(values.Get("groups"), ","),
-				"preferred_username": values.Get("username"),
-			},
+			Extra:       extra,
 		},
+		// the key id is set by the signer, since the key might be rotated until the token is issued
 		Headers: &jwt.Headers{
-			Extra: map[string]interface{}{
-				"kid": cryptutils.KeyID(o.privateKey.PublicKey),
-			},
+			Extra: map[string]interface{}{},
 		},
 	}
 }
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+const testDiscourseSecret = "discourse-secret"
+
+// newTestProvider serves a provider with an in memory storage at /oauth2 of the returned server
+func newTestProvider(t *testing.T, discourseURL string, clients map[string]fosite.Client, opts ...OIDCOption) (*OIDCProvider, *httptest.Server) {
+	t.Helper()
+	store, err := storage.Open(storage.Config{Driver: "memory"}, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]OIDCOption{WithSecret([]byte("some-exactly-32-byte-long-secret"))}, opts...)
+	o, err := NewOIDC("/oauth2", discourse.SSOConfig{Server: discourseURL, Secret: testDiscourseSecret}, store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Route("/oauth2", o.RegisterHandlers)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return o, srv
+}
+
+// testIDToken signs an id token for subject which expires at exp
+func testIDToken(t *testing.T, o *OIDCProvider, issuer, subject string, exp time.Time) string {
+	t.Helper()
+	token, _, err := o.signer.Generate(context.Background(), jwt.MapClaims{
+		"iss": issuer,
+		"sub": subject,
+		"aud": []string{"test"},
+		"iat": exp.Add(-time.Hour).Unix(),
+		"exp": exp.Unix(),
+		"sid": "session",
+	}, &jwt.Headers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newDiscourseStub logs in every DiscourseConnect request as the user described by user
+func newDiscourseStub(t *testing.T, user url.Values) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/session/sso_provider" {
+			http.NotFound(rw, req)
+			return
+		}
+		target, err := discourseLogin(req.URL.Query().Get("sso"), user)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(rw, req, target.String(), http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// discourseLogin answers the DiscourseConnect request sso for user and returns the callback url
+func discourseLogin(sso string, user url.Values) (*url.URL, error) {
+	raw, err := base64.StdEncoding.DecodeString(sso)
+	if err != nil {
+		return nil, err
+	}
+	request, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	payload := url.Values{"nonce": {request.Get("nonce")}}
+	for k, v := range user {
+		payload[k] = v
+	}
+	response := base64.StdEncoding.EncodeToString([]byte(payload.Encode()))
+	h := hmac.New(sha256.New, []byte(testDiscourseSecret))
+	h.Write([]byte(response))
+	return url.Parse(request.Get("return_sso_url") + "?" + url.Values{"sso": {response}, "sig": {hex.EncodeToString(h.Sum(nil))}}.Encode())
+}
+
+// newBrowser returns a client keeping cookies, which stops at redirects to other hosts than the provider
+func newBrowser(t *testing.T, provider, discourse *httptest.Server) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+			if origin := req.URL.Scheme + "://" + req.URL.Host; origin != provider.URL && origin != discourse.URL {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+}
+
+// authorize sends an authorize request through the discourse login and returns the redirect to the client
+func authorize(t *testing.T, browser *http.Client, provider *httptest.Server, query url.Values) *url.URL {
+	t.Helper()
+	resp, err := browser.Get(provider.URL + "/oauth2/auth?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || loc.Host == "" {
+		t.Fatalf("authorize request was not redirected to the client: status %d", resp.StatusCode)
+	}
+	return loc
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the decoded response
+func exchangeCode(t *testing.T, provider *httptest.Server, clientID, secret string, form url.Values) map[string]interface{} {
+	t.Helper()
+	form.Set("grant_type", "authorization_code")
+	if secret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, _ := http.NewRequest(http.MethodPost, provider.URL+"/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/parkour-vienna/distrust/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// backchannelAttempts is the number of times a logout token is delivered before giving up
+	backchannelAttempts = 5
+)
+
+var backchannelClient = &http.Client{Timeout: time.Second * 10}
+
+// recordLogin remembers that the subject of the session signed into the client of the request with
+// the discourse payload values, so the client can be notified when the subject logs out
+func (o *OIDCProvider) recordLogin(ctx context.Context, ar fosite.Requester, session *openid.DefaultSession, values url.Values) error {
+	sid, _ := session.Claims.Extra["sid"].(string)
+	now := time.Now()
+	return o.store.CreateLogin(ctx, storage.Login{
+		SessionID: sid,
+		ClientID:  ar.GetClient().GetID(),
+		Subject:   session.Subject,
+		Issuer:    session.Claims.Issuer,
+		CreatedAt: now,
+		ExpiresAt: now.Add(o.clientLifespans(ar.GetClient()).RefreshToken),
+		Payload:   values,
+	})
+}
+
+// backchannelLogout sends OpenID Connect Back-Channel Logout tokens to all clients the subject signed into.
+// Tokens are delivered in the background, so slow relying parties do not delay the logout.
+func (o *OIDCProvider) backchannelLogout(ctx context.Context, subject string) {
+	logins, err := o.store.ListLogins(ctx, subject)
+	if err != nil {
+		log.Error().Err(err).Str("subject", subject).Msg("listing logins")
+		return
+	}
+	if err := o.store.DeleteLogins(ctx, subject); err != nil {
+		log.Error().Err(err).Str("subject", subject).Msg("deleting logins")
+	}
+	for _, login := range logins {
+		client, err := o.store.GetClient(ctx, login.ClientID)
+		if err != nil {
+			continue
+		}
+		dc, ok := client.(*DistrustClient)
+		if !ok || dc.BackchannelLogoutURI == "" {
+			continue
+		}
+		token, err := o.logoutToken(ctx, login)
+		if err != nil {
+			log.Error().Err(err).Str("client", login.ClientID).Msg("signing logout token")
+			continue
+		}
+		o.deliveries.Add(1)
+		go func(uri string, login storage.Login) {
+			defer o.deliveries.Done()
+			deliverLogoutToken(uri, login, token)
+		}(dc.BackchannelLogoutURI, login)
+	}
+}
+
+// Shutdown waits until the back-channel logouts in progress are delivered or ctx is done
+func (o *OIDCProvider) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		o.deliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for back-channel logouts: %w", ctx.Err())
+	}
+}
+
+func (o *OIDCProvider) logoutToken(ctx context.Context, login storage.Login) (string, error) {
+	claims := jwt.MapClaims{
+		"iss": login.Issuer,
+		"sub": login.Subject,
+		"aud": []string{login.ClientID},
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute * 2).Unix(),
+		"jti": uuid.New().String(),
+		"events": map[string]interface{}{
+			backchannelLogoutEvent: map[string]interface{}{},
+		},
+	}
+	if login.SessionID != "" {
+		claims["sid"] = login.SessionID
+	}
+	token, _, err := o.signer.Generate(ctx, claims, &jwt.Headers{Extra: map[string]interface{}{"typ": "logout+jwt"}})
+	return token, err
+}
+
+// deliverLogoutToken posts the logout token to the relying party, retrying with an exponential backoff
+func deliverLogoutToken(uri string, login storage.Login, token string) {
+	l := log.With().Str("client", login.ClientID).Str("subject", login.Subject).Str("uri", uri).Logger()
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := postLogoutToken(uri, token)
+		if err == nil {
+			l.Debug().Msg("delivered back-channel logout")
+			return
+		}
+		if !retry || attempt == backchannelAttempts {
+			l.Error().Err(err).Int("attempts", attempt).Msg("back-channel logout failed")
+			return
+		}
+		l.Warn().Err(err).Int("attempt", attempt).Msg("back-channel logout failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postLogoutToken sends a single logout request. Client errors are not retried, since the
+// relying party rejected the token.
+func postLogoutToken(uri, token string) (bool, error) {
+	body := url.Values{"logout_token": {token}}.Encode()
+	resp, err := backchannelClient.Post(uri, "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("relying party returned %s: %s", resp.Status, string(msg))
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+// jwtPart decodes the json of the header (0) or the claims (1) of token
+func jwtPart(t *testing.T, token string, part int) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("%q is not a jwt", token)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[part])
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	rp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		tokens = append(tokens, req.PostFormValue("logout_token"))
+		// the first delivery fails, so the token is sent again
+		if len(tokens) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(rp.Close)
+	o, _ := newTestProvider(t, "https://discourse.example.com", map[string]fosite.Client{
+		"test": &DistrustClient{
+			DefaultClient: fosite.DefaultClient{
+				ID:            "test",
+				Public:        true,
+				RedirectURIs:  []string{"https://rp.example.com/cb"},
+				ResponseTypes: []string{"code"},
+				GrantTypes:    []string{"authorization_code"},
+				Scopes:        []string{"openid"},
+			},
+			BackchannelLogoutURI: rp.URL + "/logout",
+		},
+	})
+	now := time.Now()
+	if err := o.store.CreateLogin(t.Context(), storage.Login{
+		SessionID: "some-sid",
+		ClientID:  "test",
+		Subject:   "42",
+		Issuer:    "https://distrust.example.com/oauth2",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	o.backchannelLogout(t.Context(), "42")
+	if logins, err := o.store.ListLogins(t.Context(), "42"); err != nil || len(logins) != 0 {
+		t.Errorf("logins were not deleted: %v %v", logins, err)
+	}
+	if err := o.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != 2 || tokens[0] != tokens[1] {
+		t.Fatalf("got %d deliveries, want the same token delivered twice", len(tokens))
+	}
+	if typ := jwtPart(t, tokens[0], 0)["typ"]; typ != "logout+jwt" {
+		t.Errorf("logout token has type %v", typ)
+	}
+	claims := jwtPart(t, tokens[0], 1)
+	if claims["sub"] != "42" || claims["sid"] != "some-sid" || claims["iss"] != "https://distrust.example.com/oauth2" {
+		t.Errorf("got logout token claims %v", claims)
+	}
+	if aud, _ := claims["aud"].([]interface{}); len(aud) != 1 || aud[0] != "test" {
+		t.Errorf("logout token has audience %v", claims["aud"])
+	}
+	events, _ := claims["events"].(map[string]interface{})
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		t.Errorf("logout token has events %v", claims["events"])
+	}
+	if _, ok := claims["nonce"]; ok {
+		t.Error("logout token contains a nonce")
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ory/fosite"
+	"github.com/rs/zerolog/log"
+)
+
+// reservedClaims are set by distrust and fosite and can not be mapped
+var reservedClaims = []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "auth_time", "rat", "nonce", "sid", "at_hash", "c_hash", "acr", "amr", "azp"}
+
+// ClaimMapping describes how a claim is built from the DiscourseConnect payload. The claim is either
+// a static Value, the result of a Template executed with the payload fields or the payload Field itself.
+// String results can be lowercased, split into a list and prefixed, in this order.
+type ClaimMapping struct {
+	Field    string
+	Value    interface{}
+	Template string
+	// Split turns the value into a list, separated by Split. Empty elements are dropped.
+	Split     string
+	Lowercase bool
+	// Prefix is prepended to the value or to every element of the list
+	Prefix string
+	// Type converts the value to a string (default), bool or int
+	Type string
+	// Scope releases the claim. It defaults to the scope of the standard claim with the same name or profile.
+	Scope string
+
+	tmpl *template.Template
+}
+
+// ClaimMappings maps claim names to their mapping
+type ClaimMappings map[string]*ClaimMapping
+
+// Validate checks all mappings and compiles their templates
+func (m ClaimMappings) Validate() error {
+	for name, c := range m {
+		if c == nil {
+			return fmt.Errorf("claim %s: mapping is empty", name)
+		}
+		if slices.Contains(reservedClaims, name) {
+			return fmt.Errorf("claim %s can not be mapped", name)
+		}
+		sources := 0
+		for _, set := range []bool{c.Field != "", c.Value != nil, c.Template != ""} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("claim %s: exactly one of field, value or template is required", name)
+		}
+		switch c.Type {
+		case "", "string", "bool", "int":
+		default:
+			return fmt.Errorf("claim %s: unknown type %q", name, c.Type)
+		}
+		if c.Split != "" && c.Type != "" && c.Type != "string" {
+			return fmt.Errorf("claim %s: split values can only be strings", name)
+		}
+		if c.Template != "" {
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse(c.Template)
+			if err != nil {
+				return fmt.Errorf("claim %s: %w", name, err)
+			}
+			c.tmpl = tmpl
+		}
+	}
+	return nil
+}
+
+// merge returns the mappings of m overridden by the mappings of client
+func (m ClaimMappings) merge(client ClaimMappings) ClaimMappings {
+	if len(client) == 0 {
+		return m
+	}
+	merged := make(ClaimMappings, len(m)+len(client))
+	for name, c := range m {
+		merged[name] = c
+	}
+	for name, c := range client {
+		merged[name] = c
+	}
+	return merged
+}
+
+// apply adds the mapped claims to claims. Claims whose payload field is empty are left out.
+func (m ClaimMappings) apply(claims map[string]interface{}, values url.Values) {
+	for name, c := range m {
+		v, err := c.resolve(values)
+		if err != nil {
+			log.Warn().Err(err).Str("claim", name).Msg("mapping claim")
+			continue
+		}
+		if v == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = v
+	}
+}
+
+func (c *ClaimMapping) resolve(values url.Values) (interface{}, error) {
+	if c.Value != nil {
+		return c.Value, nil
+	}
+	var raw string
+	if c.tmpl != nil {
+		fields := make(map[string]string, len(values))
+		for k := range values {
+			fields[k] = values.Get(k)
+		}
+		var b strings.Builder
+		if err := c.tmpl.Execute(&b, fields); err != nil {
+			return nil, err
+		}
+		raw = b.String()
+	} else {
+		raw = values.Get(c.Field)
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	if c.Lowercase {
+		raw = strings.ToLower(raw)
+	}
+	if c.Split != "" {
+		list := []string{}
+		for _, e := range strings.Split(raw, c.Split) {
+			if e != "" {
+				list = append(list, c.Prefix+e)
+			}
+		}
+		return list, nil
+	}
+	raw = c.Prefix + raw
+	switch c.Type {
+	case "bool":
+		return strconv.ParseBool(raw)
+	case "int":
+		return strconv.Atoi(raw)
+	}
+	return raw, nil
+}
+
+// claimScope returns the scope which releases the claim, or an empty string if it is always released
+func claimScope(name string, mappings ClaimMappings) string {
+	if c, ok := mappings[name]; ok && c.Scope != "" {
+		return c.Scope
+	}
+	for scope, names := range scopeClaims {
+		if slices.Contains(names, name) {
+			return scope
+		}
+	}
+	if _, ok := mappings[name]; ok {
+		return "profile"
+	}
+	return ""
+}
+
+// claimMappings returns the global mappings merged with the mappings of the client
+func (o *OIDCProvider) claimMappings(client fosite.Client) ClaimMappings {
+	if dc, ok := client.(*DistrustClient); ok {
+		return o.claims.merge(dc.Claims)
+	}
+	return o.claims
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestClaimMappingResolve(t *testing.T) {
+	values := url.Values{
+		"username":   {"Alice"},
+		"name":       {"Alice Example"},
+		"groups":     {"team,,Trainers"},
+		"admin":      {"true"},
+		"moderator":  {"maybe"},
+		"user_id":    {"42"},
+		"trust":      {"three"},
+		"avatar_url": {""},
+	}
+	for _, tc := range []struct {
+		name    string
+		mapping ClaimMapping
+		want    interface{}
+		err     bool
+	}{
+		{"field", ClaimMapping{Field: "username"}, "Alice", false},
+		{"missing field", ClaimMapping{Field: "locale"}, nil, false},
+		{"empty field", ClaimMapping{Field: "avatar_url"}, nil, false},
+		{"value", ClaimMapping{Value: "parkour-vienna"}, "parkour-vienna", false},
+		{"list value", ClaimMapping{Value: []interface{}{"a", "b"}}, []interface{}{"a", "b"}, false},
+		{"template", ClaimMapping{Template: "{{.name}} (@{{.username}})"}, "Alice Example (@Alice)", false},
+		{"template with missing field", ClaimMapping{Template: "{{.locale}}"}, nil, false},
+		{"lowercase", ClaimMapping{Field: "username", Lowercase: true}, "alice", false},
+		{"prefix", ClaimMapping{Field: "username", Prefix: "discourse:"}, "discourse:Alice", false},
+		{"split", ClaimMapping{Field: "groups", Split: ","}, []string{"team", "Trainers"}, false},
+		{"split lowercase with prefix", ClaimMapping{Field: "groups", Split: ",", Lowercase: true, Prefix: "g:"}, []string{"g:team", "g:trainers"}, false},
+		{"string", ClaimMapping{Field: "user_id", Type: "string"}, "42", false},
+		{"bool", ClaimMapping{Field: "admin", Type: "bool"}, true, false},
+		{"invalid bool", ClaimMapping{Field: "moderator", Type: "bool"}, nil, true},
+		{"int", ClaimMapping{Field: "user_id", Type: "int"}, 42, false},
+		{"int from template", ClaimMapping{Template: "1{{.user_id}}", Type: "int"}, 142, false},
+		{"invalid int", ClaimMapping{Field: "trust", Type: "int"}, nil, true},
+		{"prefixed int", ClaimMapping{Field: "user_id", Prefix: "u", Type: "int"}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := ClaimMappings{"claim": &tc.mapping}
+			if err := m.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m["claim"].resolve(values)
+			if (err != nil) != tc.err {
+				t.Fatalf("got error %v, want error %v", err, tc.err)
+			}
+			if !tc.err && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClaimMappingsApply(t *testing.T) {
+	global := ClaimMappings{
+		"nickname": {Field: "username"},
+		"is_admin": {Field: "admin", Type: "bool"},
+		"level":    {Field: "trust_level", Type: "int"},
+	}
+	client := ClaimMappings{
+		// replaces the standard claim
+		"email": {Field: "secondary_email"},
+		// overrides the global mapping
+		"nickname": {Template: "@{{.username}}"},
+		// replaces the standard claim, but the payload field is missing
+		"picture": {Field: "avatar_template"},
+	}
+	merged := global.merge(client)
+	if err := merged.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{
+		"sid":     "session",
+		"email":   "alice@example.com",
+		"picture": "https://discourse.example.com/alice.png",
+		"level":   1,
+	}
+	merged.apply(claims, url.Values{
+		"username":        {"alice"},
+		"admin":           {"false"},
+		"trust_level":     {"three"},
+		"secondary_email": {"alice@work.example.com"},
+	})
+	want := map[string]interface{}{
+		"sid":      "session",
+		"email":    "alice@work.example.com",
+		"nickname": "@alice",
+		"is_admin": false,
+		// the failing conversion keeps the previous value
+		"level": 1,
+	}
+	if !reflect.DeepEqual(claims, want) {
+		t.Errorf("got claims %v, want %v", claims, want)
+	}
+	if len(global) != 3 || global["nickname"].Field != "username" {
+		t.Error("global mappings were modified by the merge")
+	}
+	if got := global.merge(nil); !reflect.DeepEqual(got, global) {
+		t.Error("merge without client mappings changed the global ones")
+	}
+}
+
+func TestClaimScope(t *testing.T) {
+	mappings := ClaimMappings{
+		"nickname": {Field: "username"},
+		"tenant":   {Value: "parkour-vienna", Scope: "groups"},
+		"email":    {Field: "secondary_email"},
+		"name":     {Template: "{{.username}}", Scope: "email"},
+	}
+	for claim, want := range map[string]string{
+		"sid":      "",
+		"groups":   "groups",
+		"nickname": "profile",
+		"tenant":   "groups",
+		"email":    "email",
+		"name":     "email",
+		"picture":  "profile",
+	} {
+		if got := claimScope(claim, mappings); got != want {
+			t.Errorf("claim %s is released with scope %q, want %q", claim, got, want)
+		}
+	}
+}
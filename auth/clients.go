@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/policy"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+var (
+	supportedGrantTypes    = []string{"authorization_code", "refresh_token", "implicit", "client_credentials"}
+	supportedResponseTypes = []string{"code", "id_token", "token", "id_token token", "code id_token", "code token", "code id_token token"}
+	supportedAuthMethods   = []string{"client_secret_basic", "client_secret_post", "none"}
+)
+
+var (
+	_ fosite.OpenIDConnectClient            = (*DistrustClient)(nil)
+	_ fosite.ClientWithCustomTokenLifespans = (*DistrustClient)(nil)
+)
+
+// Validate checks the grant types, response types and authentication method of a client
+// and rejects combinations which are unsafe or can never be used
+func (c *DistrustClient) Validate() error {
+	if err := subset("grant type", c.GrantTypes, supportedGrantTypes); err != nil {
+		return err
+	}
+	if err := subset("response type", c.ResponseTypes, supportedResponseTypes); err != nil {
+		return err
+	}
+	method := c.GetTokenEndpointAuthMethod()
+	if err := subset("token endpoint auth method", []string{method}, supportedAuthMethods); err != nil {
+		return err
+	}
+	if err := checkResponseTypes(c.GrantTypes, c.ResponseTypes); err != nil {
+		return err
+	}
+	if len(c.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	if c.Public != (method == "none") {
+		return errors.New("public clients must use the token endpoint auth method none and vice versa")
+	}
+	if c.Public {
+		if len(c.Secret) != 0 {
+			return errors.New("public clients can not have a secret")
+		}
+		if slices.Contains(c.GrantTypes, "client_credentials") {
+			return errors.New("public clients can not use the client_credentials grant")
+		}
+	} else if len(c.Secret) == 0 {
+		return errors.New("confidential clients require a secret")
+	}
+	if err := c.PKCE.Validate(); err != nil {
+		return err
+	}
+	if err := c.Claims.Validate(); err != nil {
+		return err
+	}
+	if err := c.Lifespans.Validate(); err != nil {
+		return err
+	}
+	if c.Public && c.PKCE == PKCEOptional {
+		return errors.New("public clients always require pkce")
+	}
+	if slices.Contains(c.GrantTypes, "refresh_token") && !slices.Contains(c.GrantTypes, "authorization_code") {
+		return errors.New("the refresh_token grant requires the authorization_code grant")
+	}
+	return nil
+}
+
+// checkResponseTypes makes sure every response type can be issued with the given grant types
+func checkResponseTypes(grantTypes, responseTypes []string) error {
+	for _, rt := range responseTypes {
+		if strings.Contains(rt, "code") && !slices.Contains(grantTypes, "authorization_code") {
+			return fmt.Errorf("response type %s requires the authorization_code grant type", rt)
+		}
+		if strings.Contains(rt, "token") && !slices.Contains(grantTypes, "implicit") {
+			return fmt.Errorf("response type %s requires the implicit grant type", rt)
+		}
+	}
+	return nil
+}
+
+// GetTokenEndpointAuthMethod returns the configured method, defaulting to none for public
+// clients and client_secret_basic for all others
+func (c *DistrustClient) GetTokenEndpointAuthMethod() string {
+	switch {
+	case c.TokenEndpointAuthMethod != "":
+		return c.TokenEndpointAuthMethod
+	case c.Public:
+		return "none"
+	default:
+		return "client_secret_basic"
+	}
+}
+
+// distrust does not support request objects or private key jwt client authentication,
+// the remaining methods of fosite.OpenIDConnectClient are therefore empty
+
+func (c *DistrustClient) GetRequestURIs() []string                     { return nil }
+func (c *DistrustClient) GetJSONWebKeys() *jose.JSONWebKeySet          { return nil }
+func (c *DistrustClient) GetJSONWebKeysURI() string                    { return "" }
+func (c *DistrustClient) GetRequestObjectSigningAlgorithm() string     { return "" }
+func (c *DistrustClient) GetTokenEndpointAuthSigningAlgorithm() string { return "" }
+
+// storedClient is the data of a registered client kept in the storage
+type storedClient struct {
+	Metadata ClientMetadata `json:"metadata"`
+	GroupRules
+	Policy    string     `json:"policy,omitempty"`
+	Lifespans *Lifespans `json:"lifespans,omitempty"`
+}
+
+// decodeClient is the storage.ClientDecoder for clients registered at runtime
+func decodeClient(rc *storage.RegisteredClient) (fosite.Client, error) {
+	var sc storedClient
+	if err := json.Unmarshal([]byte(rc.Data), &sc); err != nil {
+		return nil, fmt.Errorf("decoding client %s: %w", rc.ID, err)
+	}
+	m := sc.Metadata
+	var p *policy.Policy
+	if sc.Policy != "" {
+		var err error
+		if p, err = policy.Compile(sc.Policy); err != nil {
+			return nil, fmt.Errorf("decoding client %s: %w", rc.ID, err)
+		}
+	}
+	client := &DistrustClient{
+		DefaultClient: fosite.DefaultClient{
+			ID:            rc.ID,
+			Secret:        []byte(rc.SecretHash),
+			RedirectURIs:  m.RedirectURIs,
+			GrantTypes:    m.GrantTypes,
+			ResponseTypes: m.ResponseTypes,
+			Scopes:        strings.Fields(m.Scope),
+			Public:        m.TokenEndpointAuthMethod == "none",
+		},
+		GroupRules:              sc.GroupRules,
+		PostLogoutRedirectURIs:  m.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:    m.BackchannelLogoutURI,
+		TokenEndpointAuthMethod: m.TokenEndpointAuthMethod,
+		Policy:                  p,
+		registered:              true,
+	}
+	if sc.Lifespans != nil {
+		client.Lifespans = *sc.Lifespans
+	}
+	return client, nil
+}
+
+func encodeClient(sc storedClient) (string, error) {
+	raw, err := json.Marshal(sc)
+	return string(raw), err
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+)
+
+func TestClientValidate(t *testing.T) {
+	confidential := func() *DistrustClient {
+		return &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "app",
+			Secret:        []byte("$2a$10$hashed"),
+			RedirectURIs:  []string{"https://app.example.com/cb"},
+			GrantTypes:    []string{"authorization_code", "refresh_token"},
+			ResponseTypes: []string{"code"},
+			Scopes:        []string{"openid"},
+		}}
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(c *DistrustClient)
+		err    string
+	}{
+		{"confidential client", func(c *DistrustClient) {}, ""},
+		{"client secret post", func(c *DistrustClient) { c.TokenEndpointAuthMethod = "client_secret_post" }, ""},
+		{"client credentials", func(c *DistrustClient) {
+			c.GrantTypes = []string{"client_credentials"}
+			c.ResponseTypes = nil
+		}, ""},
+		{"implicit", func(c *DistrustClient) {
+			c.GrantTypes = []string{"implicit"}
+			c.ResponseTypes = []string{"id_token", "id_token token"}
+		}, ""},
+		{"hybrid", func(c *DistrustClient) {
+			c.GrantTypes = []string{"authorization_code", "implicit"}
+			c.ResponseTypes = []string{"code id_token token"}
+		}, ""},
+		{"public client", func(c *DistrustClient) {
+			c.Public, c.Secret = true, nil
+		}, ""},
+		{"public client with auth method none", func(c *DistrustClient) {
+			c.Public, c.Secret, c.TokenEndpointAuthMethod = true, nil, "none"
+		}, ""},
+		{"per client overrides", func(c *DistrustClient) {
+			c.PKCE = PKCES256Only
+			c.Claims = ClaimMappings{"nickname": {Field: "username"}}
+			c.Lifespans = Lifespans{AccessToken: time.Minute}
+		}, ""},
+
+		{"password grant", func(c *DistrustClient) { c.GrantTypes = []string{"authorization_code", "password"} }, `grant type "password" is not supported`},
+		{"unknown response type", func(c *DistrustClient) { c.ResponseTypes = []string{"code", "device"} }, `response type "device" is not supported`},
+		{"unknown auth method", func(c *DistrustClient) { c.TokenEndpointAuthMethod = "private_key_jwt" }, `token endpoint auth method "private_key_jwt" is not supported`},
+		{"code without grant", func(c *DistrustClient) {
+			c.GrantTypes = []string{"implicit"}
+			c.ResponseTypes = []string{"code id_token"}
+		}, "response type code id_token requires the authorization_code grant type"},
+		{"token without implicit grant", func(c *DistrustClient) { c.ResponseTypes = []string{"code token"} }, "response type code token requires the implicit grant type"},
+		{"no scopes", func(c *DistrustClient) { c.Scopes = nil }, "at least one scope is required"},
+		{"confidential client without secret", func(c *DistrustClient) { c.Secret = nil }, "confidential clients require a secret"},
+		{"confidential client with auth method none", func(c *DistrustClient) { c.TokenEndpointAuthMethod = "none" }, "public clients must use the token endpoint auth method none and vice versa"},
+		{"public client with secret auth method", func(c *DistrustClient) {
+			c.Public, c.Secret, c.TokenEndpointAuthMethod = true, nil, "client_secret_basic"
+		}, "public clients must use the token endpoint auth method none and vice versa"},
+		{"public client with secret", func(c *DistrustClient) { c.Public = true }, "public clients can not have a secret"},
+		{"public client with client credentials", func(c *DistrustClient) {
+			c.Public, c.Secret = true, nil
+			c.GrantTypes = append(c.GrantTypes, "client_credentials")
+		}, "public clients can not use the client_credentials grant"},
+		{"public client with optional pkce", func(c *DistrustClient) {
+			c.Public, c.Secret, c.PKCE = true, nil, PKCEOptional
+		}, "public clients always require pkce"},
+		{"unknown pkce policy", func(c *DistrustClient) { c.PKCE = "always" }, `unknown pkce policy "always"`},
+		{"invalid claim mapping", func(c *DistrustClient) { c.Claims = ClaimMappings{"sub": {Field: "username"}} }, "claim sub can not be mapped"},
+		{"negative lifespan", func(c *DistrustClient) { c.Lifespans = Lifespans{AccessToken: -time.Minute} }, "access token lifespan can not be negative"},
+		{"refresh token without code", func(c *DistrustClient) {
+			c.GrantTypes = []string{"implicit", "refresh_token"}
+			c.ResponseTypes = []string{"id_token"}
+		}, "the refresh_token grant requires the authorization_code grant"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := confidential()
+			tc.modify(c)
+			err := c.Validate()
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("valid client rejected: %v", err)
+			case tc.err != "" && err == nil:
+				t.Errorf("invalid client accepted, want %q", tc.err)
+			case tc.err != "" && err.Error() != tc.err:
+				t.Errorf("got error %q, want %q", err, tc.err)
+			}
+		})
+	}
+}
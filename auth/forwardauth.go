@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/rs/zerolog/log"
+)
+
+// forwardAuthCallback is the path on the protected host which receives the discourse response.
+// Requests to it pass the proxy's auth check as well, so the session cookie is set on the protected host.
+const forwardAuthCallback = "/_distrust/callback"
+
+// ForwardAuth authenticates requests for reverse proxies like traefik, caddy or nginx. The proxy
+// passes every request to the forward auth endpoint, which lets it through if the user has a valid
+// session and is allowed to access the requested host.
+type ForwardAuth struct {
+	discourse discourse.SSOConfig
+	hosts     map[string]GroupRules
+	sessions  *sessionCookies
+}
+
+// NewForwardAuth creates a forward auth handler protecting the given hosts. Sessions are sealed with a
+// key derived from secret and are valid for lifetime.
+func NewForwardAuth(disc discourse.SSOConfig, secret []byte, hosts map[string]GroupRules, lifetime time.Duration) *ForwardAuth {
+	normalized := make(map[string]GroupRules, len(hosts))
+	for host, rules := range hosts {
+		normalized[strings.ToLower(host)] = rules
+	}
+	return &ForwardAuth{
+		discourse: disc,
+		hosts:     normalized,
+		sessions:  newSessionCookies(secret, "distrust_auth", lifetime),
+	}
+}
+
+func (f *ForwardAuth) RegisterHandlers(r chi.Router) {
+	r.HandleFunc("/", f.forwardAuthEndpoint)
+}
+
+func (f *ForwardAuth) forwardAuthEndpoint(rw http.ResponseWriter, req *http.Request) {
+	original, err := forwardedURL(req)
+	if err != nil {
+		log.Warn().Err(err).Msg("parsing forwarded request")
+		http.Error(rw, "invalid forwarded request", http.StatusBadRequest)
+		return
+	}
+	rules, ok := f.hosts[strings.ToLower(original.Hostname())]
+	if !ok {
+		log.Warn().Str("host", original.Host).Msg("forward auth request for unknown host")
+		http.Error(rw, "host is not protected by distrust", http.StatusForbidden)
+		return
+	}
+	secure := original.Scheme == "https"
+
+	if original.Path == forwardAuthCallback {
+		f.callback(rw, req, original, secure)
+		return
+	}
+
+	session, err := f.sessions.getSession(req)
+	if err != nil {
+		f.login(rw, req, original, secure)
+		return
+	}
+	if err := validateAccess(rules, session.Groups, nil); err != nil {
+		log.Info().Err(err).Str("username", session.Username).Str("host", original.Host).Msg("forward auth denied")
+		http.Error(rw, "You are not allowed to access this application: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("X-Forwarded-User", session.Username)
+	rw.Header().Set("X-Forwarded-Email", session.Email)
+	rw.Header().Set("X-Forwarded-Groups", strings.Join(session.Groups, ","))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// login starts the discourse sso flow, returning to the callback on the protected host
+func (f *ForwardAuth) login(rw http.ResponseWriter, req *http.Request, original *url.URL, secure bool) {
+	nonce := rand.Int()
+	if err := f.sessions.setState(rw, secure, nonce, original.String()); err != nil {
+		log.Error().Err(err).Msg("storing login state")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	callback := original.Scheme + "://" + original.Host + forwardAuthCallback
+	forwardRedirect(rw, req, discourse.GenerateURL(f.discourse.Server, callback, f.discourse.Secret, nonce))
+}
+
+func (f *ForwardAuth) callback(rw http.ResponseWriter, req *http.Request, original *url.URL, secure bool) {
+	state, err := f.sessions.getState(rw, req, secure)
+	if err != nil {
+		log.Warn().Err(err).Msg("restoring login state")
+		http.Error(rw, "invalid session, please try again", http.StatusBadRequest)
+		return
+	}
+	// the state of another protected host must not redirect away from this one
+	if target, err := url.Parse(state.Redirect); err != nil || !strings.EqualFold(target.Host, original.Host) {
+		log.Warn().Str("redirect", state.Redirect).Str("host", original.Host).Msg("login state of another host")
+		http.Error(rw, "invalid session, please try again", http.StatusBadRequest)
+		return
+	}
+	q := original.Query()
+	values, err := discourse.ValidateResponse(q.Get("sso"), q.Get("sig"), f.discourse.Secret, state.Nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("validating discourse response")
+		http.Error(rw, "invalid discourse response", http.StatusBadRequest)
+		return
+	}
+	session, err := f.sessions.setSession(rw, secure, values)
+	if err != nil {
+		log.Error().Err(err).Msg("storing session")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("username", session.Username).Str("host", original.Host).Msg("user logged in through forward auth")
+	forwardRedirect(rw, req, state.Redirect)
+}
+
+// forwardedURL reconstructs the url of the original request from the headers set by the proxy
+func forwardedURL(req *http.Request) (*url.URL, error) {
+	scheme := req.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = req.Host
+	}
+	uri := req.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	return url.Parse(scheme + "://" + host + uri)
+}
+
+// forwardRedirect sends the user to target. nginx' auth_request does not pass redirects to the client,
+// so with ?redirect=false the location is returned with a 401 instead.
+func forwardRedirect(rw http.ResponseWriter, req *http.Request, target string) {
+	if req.URL.Query().Get("redirect") == "false" {
+		rw.Header().Set("Location", target)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(rw, req, target, http.StatusFound)
+}
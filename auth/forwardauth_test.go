@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkour-vienna/distrust/discourse"
+)
+
+var forwardAuthUser = url.Values{
+	"external_id": {"42"},
+	"username":    {"alice"},
+	"email":       {"alice@example.com"},
+	"groups":      {"team,trainers"},
+}
+
+func newTestForwardAuth(lifetime time.Duration) *ForwardAuth {
+	return NewForwardAuth(discourse.SSOConfig{Server: "https://discourse.example.com", Secret: testDiscourseSecret}, []byte("some-exactly-32-byte-long-secret"), map[string]GroupRules{
+		"App.example.com":   {},
+		"admin.example.com": {AllowGroups: []string{"admins"}},
+	}, lifetime)
+}
+
+// forwardAuth sends the request of the proxy for the original url to f
+func forwardAuth(f *ForwardAuth, original string, cookies ...*http.Cookie) *http.Response {
+	u, _ := url.Parse(original)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", u.Scheme)
+	req.Header.Set("X-Forwarded-Host", u.Host)
+	req.Header.Set("X-Forwarded-Uri", u.RequestURI())
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	f.forwardAuthEndpoint(rec, req)
+	return rec.Result()
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// forwardAuthLogin logs in through discourse for original and returns the response of the callback
+func forwardAuthLogin(t *testing.T, f *ForwardAuth, original string) *http.Response {
+	t.Helper()
+	resp := forwardAuth(f, original)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login was not started: %d", resp.StatusCode)
+	}
+	state := responseCookie(resp, "distrust_auth_state")
+	if state == nil {
+		t.Fatal("no login state stored")
+	}
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	callback, err := discourseLogin(loc.Query().Get("sso"), forwardAuthUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwardAuth(f, callback.String(), state)
+}
+
+func TestForwardAuth(t *testing.T) {
+	f := newTestForwardAuth(time.Hour)
+
+	resp := forwardAuth(f, "https://app.example.com/page?x=1")
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || loc.Host != "discourse.example.com" {
+		t.Fatalf("user without session was not sent to discourse: %d %s", resp.StatusCode, loc)
+	}
+
+	resp = forwardAuthLogin(t, f, "https://app.example.com/page?x=1")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://app.example.com/page?x=1" {
+		t.Fatalf("callback did not return to the original url: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	session := responseCookie(resp, "distrust_auth")
+	if session == nil || !session.Secure || !session.HttpOnly {
+		t.Fatalf("session cookie %v was not stored securely", session)
+	}
+
+	resp = forwardAuth(f, "https://app.example.com/other", session)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("user with session was not let through: %d", resp.StatusCode)
+	}
+	for header, want := range map[string]string{
+		"X-Forwarded-User":   "alice",
+		"X-Forwarded-Email":  "alice@example.com",
+		"X-Forwarded-Groups": "team,trainers",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s is %q, want %q", header, got, want)
+		}
+	}
+
+	// host rules are looked up case insensitively, and the session is valid for all hosts
+	if resp = forwardAuth(f, "https://APP.example.com/", session); resp.StatusCode != http.StatusOK {
+		t.Errorf("host was not matched case insensitively: %d", resp.StatusCode)
+	}
+	if resp = forwardAuth(f, "https://admin.example.com/", session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("user outside the allowed groups was let through: %d", resp.StatusCode)
+	}
+	if resp = forwardAuth(f, "https://unknown.example.com/", session); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request for an unknown host was let through: %d", resp.StatusCode)
+	}
+}
+
+func TestForwardAuthWithoutRedirect(t *testing.T) {
+	f := newTestForwardAuth(time.Hour)
+	resp := forwardAuth(f, "https://app.example.com/?redirect=false")
+	// the proxy passes the query of the forward auth request, not the one of the original url
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("redirect=false of the original url was honored: %d", resp.StatusCode)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?redirect=false", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/page")
+	rec := httptest.NewRecorder()
+	f.forwardAuthEndpoint(rec, req)
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusUnauthorized || loc.Host != "discourse.example.com" {
+		t.Fatalf("got %d with location %s, want 401 with the discourse login", rec.Code, loc)
+	}
+	if responseCookie(rec.Result(), "distrust_auth_state") == nil {
+		t.Error("no login state stored")
+	}
+}
+
+func TestForwardAuthSessionExpiry(t *testing.T) {
+	// sessions expire right after the login
+	f := newTestForwardAuth(-time.Second)
+	session := responseCookie(forwardAuthLogin(t, f, "https://app.example.com/"), "distrust_auth")
+	if session == nil {
+		t.Fatal("no session stored")
+	}
+	resp := forwardAuth(f, "https://app.example.com/", session)
+	if loc, _ := url.Parse(resp.Header.Get("Location")); resp.StatusCode != http.StatusFound || loc.Host != "discourse.example.com" {
+		t.Errorf("expired session was accepted: %d %s", resp.StatusCode, loc)
+	}
+
+	// sessions of another secret are not accepted
+	session = responseCookie(forwardAuthLogin(t, newTestForwardAuth(time.Hour), "https://app.example.com/"), "distrust_auth")
+	other := NewForwardAuth(discourse.SSOConfig{Secret: testDiscourseSecret}, []byte("another-exactly-32-byte-secret!!"), map[string]GroupRules{"app.example.com": {}}, time.Hour)
+	if resp := forwardAuth(other, "https://app.example.com/", session); resp.StatusCode != http.StatusFound {
+		t.Errorf("session sealed with another secret was accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestForwardAuthRedirects(t *testing.T) {
+	f := newTestForwardAuth(time.Hour)
+
+	// forwarded uris which change the host of the original url are not protected
+	for _, uri := range []string{"@evil.example.com/", ".evil.example.com/", ":443@evil.example.com/"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "app.example.com")
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rec := httptest.NewRecorder()
+		f.forwardAuthEndpoint(rec, req)
+		if rec.Code != http.StatusForbidden && rec.Code != http.StatusBadRequest {
+			t.Errorf("forwarded uri %s: got %d with location %s", uri, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	// a path looking like a host stays on the protected host
+	resp := forwardAuthLogin(t, f, "https://app.example.com//evil.example.com/")
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "https://app.example.com/") {
+		t.Errorf("callback redirected to %s", loc)
+	}
+
+	// the login state of one protected host can not be used to redirect from another one
+	resp = forwardAuth(f, "https://admin.example.com/")
+	state := responseCookie(resp, "distrust_auth_state")
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	callback, err := discourseLogin(loc.Query().Get("sso"), forwardAuthUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.Host = "app.example.com"
+	if resp = forwardAuth(f, callback.String(), state); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("login state of another host was accepted: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -1,12 +1,14 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,75 +16,152 @@ import (
 	"github.com/google/uuid"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/openid"
-	"github.com/parkour-vienna/distrust/cryptutils"
+	"github.com/parkour-vienna/distrust/audit"
 	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/metrics"
+	"github.com/parkour-vienna/distrust/tracing"
 	"github.com/rs/zerolog/log"
-	jose "github.com/go-jose/go-jose/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (o *OIDCProvider) authEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := req.Context()
+	ctx, span := tracing.Start(req.Context(), "authorize")
+	defer span.End()
+	req = req.WithContext(ctx)
 
 	// Let's create an AuthorizeRequest object!
 	// It will analyze the request and extract important information like scopes, response type and others.
 	ar, err := o.oauth2.NewAuthorizeRequest(ctx, req)
+	span.SetAttributes(attribute.String("client_id", clientID(ar)))
 	if err != nil {
 		log.Warn().Err(err).Msg("parsing authorize request")
+		metrics.AuthorizeRequest(clientLabel(ar), err)
+		tracing.Fail(span, err)
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
+		return
+	}
+	if err := o.checkPKCE(ar); err != nil {
+		log.Warn().Err(err).Str("client", ar.GetClient().GetID()).Msg("pkce policy violated")
+		metrics.AuthorizeRequest(clientLabel(ar), err)
+		tracing.Fail(span, err)
 		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
 		return
 	}
-
 	aroot := o.getAuthRoot(req)
-	callback := aroot + "/callback"
-	nonce := rand.Int()
-	url := discourse.GenerateURL(o.discourseServer, callback, o.discourseSecret, nonce)
+	prompt, err := o.parsePrompt(ctx, ar, aroot)
+	if err != nil {
+		log.Warn().Err(err).Str("client", ar.GetClient().GetID()).Msg("invalid prompt")
+		metrics.AuthorizeRequest(clientLabel(ar), err)
+		tracing.Fail(span, err)
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
+		return
+	}
+	metrics.AuthorizeRequest(clientLabel(ar), nil)
+
+	login := o.resumeSSOSession(ctx, req, o.clientLifespans(ar.GetClient()))
+	if login != nil && prompt.allows(login) {
+		span.SetAttributes(attribute.Bool("sso", true))
+		event := audit.Event{
+			Type:          audit.SessionResumed,
+			CorrelationID: login.SessionID,
+			ClientID:      clientID(ar),
+			Subject:       login.Values.Get("external_id"),
+			Username:      login.Values.Get("username"),
+		}
+		o.audit.Log(req, event)
+		if _, err := o.finishAuthorize(rw, req, ar, login, event, false); err != nil {
+			tracing.Fail(span, err)
+		}
+		return
+	}
 
-	sessionId := uuid.New()
+	// discourse does not tell when the user logged in, so only users with an sso session are logged in silently
+	if prompt.none && !(login != nil && prompt.silent() && o.discoursePrompt) {
+		err := fosite.ErrLoginRequired.WithHint("The user has to log in, but prompt was set to 'none'.")
+		tracing.Fail(span, err)
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
+		return
+	}
 
-	log.Debug().Str("sessionId", sessionId.String()).Msg("registering in flight request")
-	o.inflight[sessionId] = &InFlightRequest{
-		Nonce: nonce,
-		Ar:    ar,
+	callback := aroot + "/callback"
+	nonce := rand.Int()
+	var discoursePrompt string
+	if prompt.none {
+		discoursePrompt = "none"
 	}
-	expiration := time.Now().Add(time.Minute * 10)
-	http.SetCookie(rw, &http.Cookie{
-		Name:    "oidc_session",
-		Value:   sessionId.String(),
-		Expires: time.Now().Add(time.Minute * 10),
+	url := discourse.GenerateURLWithPrompt(o.discourseServer, callback, o.discourseSecret, nonce, discoursePrompt)
+
+	sid := uuid.New().String()
+	log.Debug().Int("nonce", nonce).Msg("registering in flight request")
+	if err := o.setInflight(rw, req, nonce, sid, ar); err != nil {
+		log.Error().Err(err).Msg("storing in flight request")
+		tracing.Fail(span, err)
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, fosite.ErrServerError.WithWrap(err))
+		return
+	}
+	o.audit.Log(req, audit.Event{
+		Type:          audit.LoginStarted,
+		CorrelationID: sid,
+		ClientID:      clientID(ar),
+		Scopes:        ar.GetRequestedScopes(),
 	})
-	go func() {
-		time.Sleep(time.Until(expiration))
-		log.Debug().Str("sessionId", sessionId.String()).Msg("deleting expired session id")
-		delete(o.inflight, sessionId)
-	}()
 	http.Redirect(rw, req, url, http.StatusTemporaryRedirect)
 }
 
 func (o *OIDCProvider) callbackEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := req.Context()
+	ctx, span := tracing.Start(req.Context(), "callback")
+	defer span.End()
+	req = req.WithContext(ctx)
 
 	log.Trace().Msg("got a discourse callback")
-	cookie, err := req.Cookie("oidc_session")
+	session, ar, err := o.getInflight(rw, req)
 	if err != nil {
-		log.Warn().Err(err).Msg("fetching cookie")
+		log.Warn().Err(err).Msg("restoring in flight request")
+		callbackOutcome(span, metrics.CallbackInvalidSession, err)
+		o.audit.Log(req, audit.Event{Type: audit.CallbackFailed, ClientID: clientID(ar), Reason: err.Error()})
+		if ar != nil {
+			o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
+			return
+		}
 		_ = json.NewEncoder(rw).Encode(map[string]string{"error": "invalid session, please try again"})
 		return
 	}
 
-	session, ok := o.inflight[uuid.MustParse(cookie.Value)]
-	if !ok {
-		_ = json.NewEncoder(rw).Encode(map[string]string{"error": "invalid session, please try again"})
-		return
+	metrics.LoginFinished()
+	if session.SessionID == "" {
+		// cookies set before the session id was stored
+		session.SessionID = uuid.New().String()
 	}
-	delete(o.inflight, uuid.MustParse(cookie.Value))
+	traceRoundTrip(ctx, session, ar)
 
 	values, err := discourse.ValidateResponse(req.URL.Query().Get("sso"), req.URL.Query().Get("sig"), o.discourseSecret, session.Nonce)
 	if err != nil {
-		o.oauth2.WriteAuthorizeError(ctx, rw, session.Ar, err)
+		switch {
+		case errors.Is(err, discourse.ErrBadSignature):
+			callbackOutcome(span, metrics.CallbackBadSignature, err)
+		case errors.Is(err, discourse.ErrBadNonce):
+			callbackOutcome(span, metrics.CallbackBadNonce, err)
+		case errors.Is(err, discourse.ErrLoginRequired):
+			callbackOutcome(span, metrics.CallbackLoginRequired, err)
+			err = fosite.ErrLoginRequired.WithHint("The user is not logged in to discourse.").WithWrap(err)
+		default:
+			callbackOutcome(span, metrics.CallbackError, err)
+		}
+		o.audit.Log(req, audit.Event{Type: audit.CallbackFailed, CorrelationID: session.SessionID, ClientID: clientID(ar), Reason: err.Error()})
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
 		return
 	}
+	event := audit.Event{
+		Type:          audit.CallbackVerified,
+		CorrelationID: session.SessionID,
+		ClientID:      clientID(ar),
+		Subject:       values.Get("external_id"),
+		Username:      values.Get("username"),
+	}
+	o.audit.Log(req, event)
 
 	nonce, _ := strconv.Atoi(values.Get("nonce"))
 
@@ -92,27 +171,59 @@ func (o *OIDCProvider) callbackEndpoint(rw http.ResponseWriter, req *http.Reques
 		Int("nonce", nonce).
 		Msg("parsed user data")
 
-	switch client := session.Ar.GetClient().(type) {
-	case *DistrustClient:
-		log.Debug().Str("client", client.GetID()).Msg("distrust client found, performing additonal validation")
-		err := validateGroups(client, values)
-		if err != nil {
-			log.Warn().Err(err).Msg("group validation failed")
-			fmt.Fprintf(rw, "You are not allowed to access this application: %s", err.Error())
+	login := &ssoSession{Values: values, SessionID: session.SessionID, AuthTime: time.Now().Unix()}
+	newLogin := true
+	if promptNone(ar) {
+		// discourse did not ask for credentials, so the user logged in with the sso session of the browser
+		sso, err := o.getSSOSession(ctx, req)
+		if err != nil || sso.Values.Get("external_id") != values.Get("external_id") {
+			err := fosite.ErrLoginRequired.WithHint("The user has no session at distrust, but prompt was set to 'none'.")
+			callbackOutcome(span, metrics.CallbackLoginRequired, err)
+			event.Type, event.Reason = audit.CallbackFailed, err.Error()
+			o.audit.Log(req, event)
+			o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
 			return
 		}
+		login.SessionID, login.AuthTime, newLogin = sso.SessionID, sso.AuthTime, false
 	}
+	outcome, err := o.finishAuthorize(rw, req, ar, login, event, newLogin)
+	callbackOutcome(span, outcome, err)
+}
 
-	// since scopes do not work with discourse, we simply grant the openid scope
-	session.Ar.GrantScope("openid")
+// finishAuthorize answers the authorize request for the user of the login, after checking they may access
+// the client. If newLogin is set, the browser keeps an sso session. The outcome is one of the callback outcomes.
+func (o *OIDCProvider) finishAuthorize(rw http.ResponseWriter, req *http.Request, ar fosite.AuthorizeRequester, login *ssoSession, event audit.Event, newLogin bool) (string, error) {
+	ctx := req.Context()
+	values := login.Values
+	roles := o.roleMappings(ar.GetClient()).Roles(strings.Split(values.Get("groups"), ","), values)
+	if err := checkAccess(ar.GetClient(), values, roles, ar.GetRequestedScopes()); err != nil {
+		log.Warn().Err(err).Msg("access validation failed")
+		event.Type, event.Reason = audit.AccessDenied, err.Error()
+		o.audit.Log(req, event)
+		if promptNone(ar) {
+			o.oauth2.WriteAuthorizeError(ctx, rw, ar, fosite.ErrAccessDenied.WithHint(err.Error()))
+			return metrics.CallbackDenied, err
+		}
+		fmt.Fprintf(rw, "You are not allowed to access this application: %s", err.Error())
+		return metrics.CallbackDenied, err
+	}
+
+	// fosite already rejected scopes the client is not allowed to request
+	for _, scope := range ar.GetRequestedScopes() {
+		ar.GrantScope(scope)
+	}
 
 	// Now we need to get a response. This is the place where the AuthorizeEndpointHandlers kick in and start processing the request.
 	// NewAuthorizeResponse is capable of running multiple response type handlers which in turn enables this library
 	// to support open id connect.
 
 	aroot := o.getAuthRoot(req)
-	mySessionData := o.newSession(aroot, values)
-	response, err := o.oauth2.NewAuthorizeResponse(req.Context(), session.Ar, mySessionData)
+	mySessionData := o.userSession(aroot, ar, values, roles)
+	mySessionData.Claims.AuthTime = time.Unix(login.AuthTime, 0).UTC()
+	// fosite compares the login to the time of the authorize request for prompt and max_age
+	mySessionData.Claims.RequestedAt = ar.GetRequestedAt().UTC().Truncate(time.Second)
+	mySessionData.Claims.Extra["sid"] = login.SessionID
+	response, err := o.oauth2.NewAuthorizeResponse(ctx, ar, mySessionData)
 
 	// Catch any errors, e.g.:
 	// * unknown client
@@ -120,36 +231,73 @@ func (o *OIDCProvider) callbackEndpoint(rw http.ResponseWriter, req *http.Reques
 	// * ...
 	if err != nil {
 		log.Warn().Err(err).Msg("building authorize response")
-		o.oauth2.WriteAuthorizeError(ctx, rw, session.Ar, err)
-		return
+		event.Type, event.Reason = audit.CallbackFailed, err.Error()
+		o.audit.Log(req, event)
+		o.oauth2.WriteAuthorizeError(ctx, rw, ar, err)
+		return metrics.CallbackError, err
+	}
+	event.Type, event.Scopes = audit.CodeIssued, ar.GetGrantedScopes()
+	if !ar.GetResponseTypes().Has("code") {
+		event.Type, event.GrantType = audit.TokenIssued, "implicit"
+	}
+	o.audit.Log(req, event)
+
+	if err := o.recordLogin(ctx, ar, mySessionData, values); err != nil {
+		log.Error().Err(err).Msg("recording login")
+	}
+	if newLogin && o.ssoEnabled() {
+		if err := o.setSSOSession(rw, req, values, login.SessionID, mySessionData.Claims.AuthTime); err != nil {
+			log.Error().Err(err).Msg("storing sso session")
+		}
 	}
 
 	// Last but not least, send the response!
-	o.oauth2.WriteAuthorizeResponse(ctx, rw, session.Ar, response)
+	o.oauth2.WriteAuthorizeResponse(ctx, rw, ar, response)
+	return metrics.CallbackSuccess, nil
 }
 
 func (o *OIDCProvider) introspectionEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := req.Context()
+	ctx, span := tracing.Start(req.Context(), "introspect")
+	defer span.End()
 
 	aroot := o.getAuthRoot(req)
 	mySessionData := o.newSession(aroot, nil)
 	ir, err := o.oauth2.NewIntrospectionRequest(ctx, req, mySessionData)
 	if err != nil {
 		log.Warn().Err(err)
+		metrics.Introspection(false, err)
+		tracing.Fail(span, err)
 		o.oauth2.WriteIntrospectionError(ctx, rw, err)
 		return
 	}
+	metrics.Introspection(ir.IsActive(), nil)
+	span.SetAttributes(attribute.Bool("active", ir.IsActive()))
+	if session, ok := ir.GetAccessRequester().GetSession().(*openid.DefaultSession); ok {
+		ar := ir.GetAccessRequester()
+		ar.SetSession(&introspectionSession{session, ar.GetGrantedScopes(), o.claimMappings(ar.GetClient())})
+	}
 
 	o.oauth2.WriteIntrospectionResponse(ctx, rw, ir)
 }
 
 func (o *OIDCProvider) revokeEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := req.Context()
+	ctx, span := tracing.Start(req.Context(), "revoke")
+	defer span.End()
 
 	// This will accept the token revocation request and validate various parameters.
 	err := o.oauth2.NewRevocationRequest(ctx, req)
+	metrics.Revocation(err)
+	if err != nil {
+		tracing.Fail(span, err)
+	} else {
+		client, _, ok := req.BasicAuth()
+		if !ok {
+			client = req.PostForm.Get("client_id")
+		}
+		o.audit.Log(req, audit.Event{Type: audit.TokenRevoked, ClientID: client})
+	}
 
 	// All done, send the response.
 	o.oauth2.WriteRevocationResponse(ctx, rw, err)
@@ -157,7 +305,8 @@ func (o *OIDCProvider) revokeEndpoint(rw http.ResponseWriter, req *http.Request)
 
 func (o *OIDCProvider) tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := req.Context()
+	ctx, span := tracing.Start(req.Context(), "token")
+	defer span.End()
 
 	// Create an empty session object which will be passed to the request handlers
 	aroot := o.getAuthRoot(req)
@@ -165,6 +314,13 @@ func (o *OIDCProvider) tokenEndpoint(rw http.ResponseWriter, req *http.Request)
 
 	// This will create an access request object and iterate through the registered TokenEndpointHandlers to validate the request.
 	accessRequest, err := o.oauth2.NewAccessRequest(ctx, req, mySessionData)
+	if err == nil {
+		err = o.checkLifespans(accessRequest)
+	}
+	if err == nil {
+		err = o.resyncUser(ctx, accessRequest)
+	}
+	span.SetAttributes(attribute.String("grant_type", grantType(req)), attribute.String("client_id", clientID(accessRequest)))
 
 	// Catch any errors, e.g.:
 	// * unknown client
@@ -172,6 +328,9 @@ func (o *OIDCProvider) tokenEndpoint(rw http.ResponseWriter, req *http.Request)
 	// * ...
 	if err != nil {
 		log.Warn().Err(err).Msg("parsing access request")
+		metrics.TokenRequest(grantType(req), clientLabel(accessRequest), err)
+		tracing.Fail(span, err)
+		o.audit.Log(req, audit.Event{Type: audit.TokenFailed, ClientID: clientID(accessRequest), GrantType: grantType(req), Reason: err.Error()})
 		o.oauth2.WriteAccessError(ctx, rw, accessRequest, err)
 		return
 	}
@@ -184,15 +343,23 @@ func (o *OIDCProvider) tokenEndpoint(rw http.ResponseWriter, req *http.Request)
 			accessRequest.GrantScope(scope)
 		}
 	}
+	if !o.clientLifespans(accessRequest.GetClient()).rotate() {
+		ctx = keepRefreshToken(ctx)
+	}
 
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
 	// and aggregate the result in response.
 	response, err := o.oauth2.NewAccessResponse(ctx, accessRequest)
 	if err != nil {
 		log.Warn().Err(err).Msg("building access response")
+		metrics.TokenRequest(grantType(req), clientLabel(accessRequest), err)
+		tracing.Fail(span, err)
+		o.audit.Log(req, audit.Event{Type: audit.TokenFailed, ClientID: clientID(accessRequest), GrantType: grantType(req), Reason: err.Error()})
 		o.oauth2.WriteAccessError(ctx, rw, accessRequest, err)
 		return
 	}
+	metrics.TokenRequest(grantType(req), clientLabel(accessRequest), nil)
+	o.audit.Log(req, tokenEvent(accessRequest, grantType(req)))
 
 	log.Info().Str("username", accessRequest.GetSession().(*openid.DefaultSession).Claims.Subject).Msg("user successfully authenticated")
 
@@ -207,12 +374,15 @@ func (o *OIDCProvider) informationEndpoint(rw http.ResponseWriter, req *http.Req
 
 	aroot := o.getAuthRoot(req)
 
-	_ = json.NewEncoder(rw).Encode(map[string]interface{}{
-		"issuer":                 aroot,
-		"authorization_endpoint": aroot + "/auth",
-		"token_endpoint":         aroot + "/token",
-		"userinfo_endpoint":      aroot + "/userinfo",
-		"jwks_uri":               aroot + "/certs",
+	info := map[string]interface{}{
+		"issuer":                               aroot,
+		"authorization_endpoint":               aroot + "/auth",
+		"token_endpoint":                       aroot + "/token",
+		"userinfo_endpoint":                    aroot + "/userinfo",
+		"jwks_uri":                             aroot + "/certs",
+		"end_session_endpoint":                 aroot + "/logout",
+		"backchannel_logout_supported":         true,
+		"backchannel_logout_session_supported": true,
 		"response_types_supported": []string{
 			"code",
 			"none",
@@ -223,23 +393,21 @@ func (o *OIDCProvider) informationEndpoint(rw http.ResponseWriter, req *http.Req
 			"code id_token token",
 		},
 		"subject_types_supported":               []string{"public", "pairwise"},
-		"id_token_signing_alg_values_supported": []string{"RS256"},
-	})
+		"id_token_signing_alg_values_supported": o.keys.Algorithms(),
+		"code_challenge_methods_supported":      o.codeChallengeMethods(),
+		"scopes_supported":                      supportedScopes,
+		"prompt_values_supported":               []string{"none", "login", "consent", "select_account"},
+		"claims_supported":                      supportedClaims(),
+	}
+	if o.registration.enabled() {
+		info["registration_endpoint"] = aroot + "/register"
+	}
+	_ = json.NewEncoder(rw).Encode(info)
 }
 
 func (o *OIDCProvider) certsEndpoint(rw http.ResponseWriter, req *http.Request) {
-	jwks := &jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Algorithm: "RS256",
-				KeyID: cryptutils.KeyID(o.privateKey.PublicKey),
-				Use:   "sig",
-				Key:   &o.privateKey.PublicKey,
-			},
-		},
-	}
 	rw.Header().Add("Content-Type", "application/json")
-	_ = json.NewEncoder(rw).Encode(jwks)
+	_ = json.NewEncoder(rw).Encode(o.keys.Public())
 }
 
 func (o *OIDCProvider) userInfoEndpoint(rw http.ResponseWriter, req *http.Request) {
@@ -262,7 +430,9 @@ func (o *OIDCProvider) userInfoEndpoint(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	info := ar.GetSession().(*openid.DefaultSession).Claims.ToMap()
+	claims := ar.GetSession().(*openid.DefaultSession).Claims
+	claims.Extra = releaseClaims(claims.Extra, ar.GetGrantedScopes(), o.claimMappings(ar.GetClient()))
+	info := claims.ToMap()
 	delete(info, "rat")
 	delete(info, "exp")
 	delete(info, "at_hash")
@@ -280,24 +450,116 @@ func (o *OIDCProvider) getAuthRoot(req *http.Request) string {
 	return aroot
 }
 
-func validateGroups(client *DistrustClient, values url.Values) error {
-	userGroups := values.Get("groups")
-	groupMap := make(map[string]bool)
-	for _, g := range strings.Split(userGroups, ",") {
-		groupMap[g] = true
+// checkAccess applies the group rules and the policy of distrust clients to the user described by values
+func checkAccess(client fosite.Client, values url.Values, roles, scopes []string) error {
+	dc, ok := client.(*DistrustClient)
+	if !ok {
+		return nil
 	}
-	for _, allowed := range client.AllowGroups {
-		if groupMap[allowed] {
-			return nil
-		}
+	log.Debug().Str("client", dc.GetID()).Msg("distrust client found, performing additonal validation")
+	if err := validateAccess(dc.GroupRules, strings.Split(values.Get("groups"), ","), roles); err != nil {
+		return err
 	}
-	if len(client.AllowGroups) != 0 {
-		return errors.New("user is not in allowed groups for this client")
+	return checkPolicy(dc, PolicyInput(values, roles, scopes, time.Now()))
+}
+
+// validateAccess checks the groups and roles of a user against the rules of an application
+func validateAccess(rules GroupRules, userGroups, userRoles []string) error {
+	if len(rules.AllowGroups) != 0 || len(rules.AllowRoles) != 0 {
+		for _, allowed := range rules.AllowGroups {
+			if slices.Contains(userGroups, allowed) {
+				return nil
+			}
+		}
+		for _, allowed := range rules.AllowRoles {
+			if slices.Contains(userRoles, allowed) {
+				return nil
+			}
+		}
+		return errors.New("user is not in allowed groups or roles for this application")
 	}
-	for _, denied := range client.DenyGroups {
-		if groupMap[denied] {
+	for _, denied := range rules.DenyGroups {
+		if slices.Contains(userGroups, denied) {
 			return errors.New("access is denied for user in group " + denied)
 		}
 	}
+	for _, denied := range rules.DenyRoles {
+		if slices.Contains(userRoles, denied) {
+			return errors.New("access is denied for user with role " + denied)
+		}
+	}
 	return nil
 }
+
+// clientID returns the id of the client of a request, which may be incomplete after an error
+func clientID(r fosite.Requester) string {
+	if r == nil || r.GetClient() == nil {
+		return ""
+	}
+	return r.GetClient().GetID()
+}
+
+// clientLabel returns the client id for metrics. Registered clients share a single label,
+// so open registration can not create an unbounded number of series.
+func clientLabel(r fosite.Requester) string {
+	if r == nil {
+		return ""
+	}
+	if c, ok := r.GetClient().(*DistrustClient); ok && c.registered {
+		return "registered"
+	}
+	return clientID(r)
+}
+
+// grantType returns the grant type of a token request for metrics, limited to the supported grant types
+func grantType(req *http.Request) string {
+	if gt := req.PostForm.Get("grant_type"); slices.Contains(supportedGrantTypes, gt) {
+		return gt
+	}
+	return "other"
+}
+
+// callbackOutcome counts the outcome of a discourse callback and records it on the span
+func callbackOutcome(span trace.Span, outcome string, err error) {
+	metrics.Callback(outcome)
+	span.SetAttributes(attribute.String("outcome", outcome))
+	if err != nil {
+		tracing.Fail(span, err)
+	}
+}
+
+// traceRoundTrip records the time the user spent at discourse as a span of the authorize
+// trace, from the redirect until the callback
+func traceRoundTrip(ctx context.Context, session *InFlightRequest, ar fosite.AuthorizeRequester) {
+	authorize := tracing.Extract(ctx, session.Trace)
+	if !authorize.IsValid() {
+		return
+	}
+	_, span := tracing.Start(trace.ContextWithRemoteSpanContext(context.Background(), authorize), "discourse",
+		trace.WithTimestamp(time.UnixMilli(session.Started)),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attribute.String("client_id", clientID(ar))),
+	)
+	span.End()
+}
+
+// tokenEvent describes tokens issued for the access request in the audit log
+func tokenEvent(ar fosite.AccessRequester, grantType string) audit.Event {
+	event := audit.Event{
+		Type:      audit.TokenIssued,
+		ClientID:  clientID(ar),
+		GrantType: grantType,
+		Scopes:    ar.GetGrantedScopes(),
+	}
+	if grantType == "refresh_token" {
+		event.Type = audit.TokenRefreshed
+	}
+	if session, ok := ar.GetSession().(*openid.DefaultSession); ok {
+		event.Subject = session.Subject
+		event.Username = session.Username
+		if session.Claims != nil {
+			event.CorrelationID, _ = session.Claims.Extra["sid"].(string)
+		}
+	}
+	return event
+}
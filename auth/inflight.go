@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/cryptutils"
+	"github.com/parkour-vienna/distrust/metrics"
+	"github.com/parkour-vienna/distrust/tracing"
+)
+
+const (
+	inflightCookie   = "oidc_session"
+	inflightLifetime = time.Minute * 10
+)
+
+// InFlightRequest is the state of a login between the authorize request and the discourse callback.
+// It is sealed into a cookie, so the callback can be handled by any instance.
+type InFlightRequest struct {
+	Nonce   int        `json:"nonce"`
+	Form    url.Values `json:"form"`
+	Expires int64      `json:"exp"`
+	// SessionID becomes the sid claim and correlates the audit events of the login
+	SessionID string `json:"sid"`
+	// Started and Trace link the callback to the trace of the authorize request
+	Started int64             `json:"started,omitempty"`
+	Trace   map[string]string `json:"trace,omitempty"`
+}
+
+func (o *OIDCProvider) setInflight(rw http.ResponseWriter, req *http.Request, nonce int, sid string, ar fosite.AuthorizeRequester) error {
+	now := time.Now()
+	expiration := now.Add(inflightLifetime)
+	raw, err := json.Marshal(&InFlightRequest{
+		Nonce:     nonce,
+		Form:      ar.GetRequestForm(),
+		Expires:   expiration.Unix(),
+		SessionID: sid,
+		Started:   now.UnixMilli(),
+		Trace:     tracing.Inject(req.Context()),
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := cryptutils.Seal(o.cookieKey, raw)
+	if err != nil {
+		return fmt.Errorf("sealing in flight request: %w", err)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     inflightCookie,
+		Value:    sealed,
+		Path:     o.root,
+		Expires:  expiration,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	metrics.LoginStarted()
+	return nil
+}
+
+// getInflight restores the in flight request from the session cookie and rebuilds
+// the original authorize request. The cookie is removed, so it can only be used once per browser.
+func (o *OIDCProvider) getInflight(rw http.ResponseWriter, req *http.Request) (*InFlightRequest, fosite.AuthorizeRequester, error) {
+	cookie, err := req.Cookie(inflightCookie)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching cookie: %w", err)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     inflightCookie,
+		Path:     o.root,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	raw, err := cryptutils.Open(o.cookieKey, cookie.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening session cookie: %w", err)
+	}
+	var ifr InFlightRequest
+	if err := json.Unmarshal(raw, &ifr); err != nil {
+		return nil, nil, fmt.Errorf("parsing session cookie: %w", err)
+	}
+	if time.Now().After(time.Unix(ifr.Expires, 0)) {
+		return nil, nil, errors.New("session expired")
+	}
+
+	areq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, o.root+"/auth?"+ifr.Form.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ar, err := o.oauth2.NewAuthorizeRequest(req.Context(), areq)
+	// the login was requested when the user was redirected to discourse
+	if r, ok := ar.(*fosite.AuthorizeRequest); ok && ifr.Started != 0 {
+		r.RequestedAt = time.UnixMilli(ifr.Started).UTC()
+	}
+	return &ifr, ar, err
+}
+
+func isSecure(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
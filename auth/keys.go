@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/parkour-vienna/distrust/cryptutils"
+	"github.com/parkour-vienna/distrust/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// KeySet manages the keys used for signing tokens. It consists of the active key which
+// signs all new tokens, the next key which will become active on the next rotation and
+// retired keys which are kept until all tokens signed by them have expired.
+// All keys are published, so relying parties already know the next key before it is used.
+type KeySet struct {
+	store    storage.Storage
+	sealKey  []byte
+	spec     cryptutils.KeySpec
+	interval time.Duration
+	retain   time.Duration
+
+	mu     sync.RWMutex
+	keys   []signingKey
+	active *signingKey
+}
+
+type signingKey struct {
+	storage.SigningKey
+	private crypto.Signer
+	alg     jose.SignatureAlgorithm
+}
+
+// NewKeySet creates a key set backed by the given storage. Private keys are sealed with a key derived from secret
+// and new keys are generated according to spec.
+// If interval is not zero, the keys are rotated automatically once the active key is older than interval.
+func NewKeySet(store storage.Storage, secret []byte, spec cryptutils.KeySpec, interval time.Duration) *KeySet {
+	return &KeySet{
+		store:    store,
+		sealKey:  cryptutils.DeriveKey(secret, "distrust signing keys"),
+		spec:     spec,
+		interval: interval,
+		retain:   maxIDTokenLifespan,
+	}
+}
+
+// init makes sure there is an active and a next key. If a configured key is passed
+// which is not known yet, it is imported and activated, retiring the current active key.
+// Once the imported key was rotated out, it is only imported again if the configured key changed.
+func (k *KeySet) init(ctx context.Context, configured crypto.Signer) error {
+	if err := k.load(ctx); err != nil {
+		return err
+	}
+	if configured != nil {
+		stored, err := k.store.ListSigningKeys(ctx)
+		if err != nil {
+			return fmt.Errorf("listing signing keys: %w", err)
+		}
+		kid := cryptutils.KeyID(configured.Public())
+		if kid != lastImported(stored) && !k.known(kid) {
+			log.Info().Str("kid", kid).Msg("importing configured private key")
+			if err := k.rotate(ctx, configured); err != nil {
+				return err
+			}
+		}
+	}
+	k.mu.RLock()
+	needsRotation := k.active == nil || !k.hasNext()
+	k.mu.RUnlock()
+	if needsRotation {
+		return k.rotate(ctx, nil)
+	}
+	return nil
+}
+
+// Rotate activates the next key, retires the currently active key and generates a new next key
+func (k *KeySet) Rotate(ctx context.Context) error {
+	return k.rotate(ctx, nil)
+}
+
+func (k *KeySet) rotate(octx context.Context, activate crypto.Signer) (err error) {
+	ctx, err := k.store.BeginTX(octx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = k.store.Rollback(ctx)
+		}
+	}()
+
+	stored, err := k.store.ListSigningKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("listing signing keys: %w", err)
+	}
+	now := time.Now()
+	imported := lastImported(stored)
+
+	var next *storage.SigningKey
+	if activate != nil {
+		next, err = k.newKey(activate, now)
+		if err != nil {
+			return err
+		}
+		next.Imported = true
+		imported = next.ID
+		// the key might still be stored from an earlier import which can not be unsealed anymore
+		if err := k.store.DeleteSigningKey(ctx, next.ID); err != nil {
+			return err
+		}
+		if err := k.store.CreateSigningKey(ctx, *next); err != nil {
+			return err
+		}
+	}
+
+	for i := range stored {
+		key := stored[i]
+		switch {
+		case activate != nil && key.ID == next.ID:
+		case expired(key, now):
+			err = k.deleteExpired(ctx, key, imported)
+		case key.State == storage.KeyStateActive:
+			key.State = storage.KeyStateRetired
+			key.RetireAt = now.Add(k.retain)
+			err = k.store.UpdateSigningKey(ctx, key)
+		case key.State == storage.KeyStateNext && next == nil && k.usable(key):
+			next = &key
+		case key.State == storage.KeyStateNext:
+			// a superseded or unusable next key has never signed anything
+			err = k.store.DeleteSigningKey(ctx, key.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("updating signing key %s: %w", key.ID, err)
+		}
+	}
+
+	if next == nil {
+		next, err = k.generateKey(ctx, now)
+		if err != nil {
+			return err
+		}
+	}
+	next.State = storage.KeyStateActive
+	next.ActivatedAt = now
+	if err := k.store.UpdateSigningKey(ctx, *next); err != nil {
+		return err
+	}
+	if _, err := k.generateKey(ctx, now); err != nil {
+		return err
+	}
+	if err := k.store.Commit(ctx); err != nil {
+		return err
+	}
+	log.Info().Str("kid", next.ID).Msg("rotated signing keys")
+	return k.load(octx)
+}
+
+func (k *KeySet) generateKey(ctx context.Context, now time.Time) (*storage.SigningKey, error) {
+	priv, err := k.spec.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("generating signing key: %w", err)
+	}
+	key, err := k.newKey(priv, now)
+	if err != nil {
+		return nil, err
+	}
+	return key, k.store.CreateSigningKey(ctx, *key)
+}
+
+func (k *KeySet) newKey(priv crypto.Signer, now time.Time) (*storage.SigningKey, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := cryptutils.Seal(k.sealKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return nil, fmt.Errorf("sealing signing key: %w", err)
+	}
+	return &storage.SigningKey{
+		ID:        cryptutils.KeyID(priv.Public()),
+		SealedKey: sealed,
+		State:     storage.KeyStateNext,
+		CreatedAt: now,
+	}, nil
+}
+
+// load reads all keys from the storage. Keys which can not be unsealed, e.g. because the
+// oidc secret changed, are skipped.
+func (k *KeySet) load(ctx context.Context) error {
+	stored, err := k.store.ListSigningKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("listing signing keys: %w", err)
+	}
+	keys := make([]signingKey, 0, len(stored))
+	var active *signingKey
+	now := time.Now()
+	for _, s := range stored {
+		if expired(s, now) {
+			continue
+		}
+		priv, err := k.unseal(s)
+		if err != nil {
+			log.Warn().Err(err).Str("kid", s.ID).Msg("skipping unusable signing key")
+			continue
+		}
+		alg, _ := cryptutils.Algorithm(priv)
+		keys = append(keys, signingKey{SigningKey: s, private: priv, alg: alg})
+	}
+	for i := range keys {
+		// concurrent rotations on multiple instances might leave more than one active key,
+		// in that case the most recently activated one wins
+		if keys[i].State == storage.KeyStateActive && (active == nil || keys[i].ActivatedAt.After(active.ActivatedAt)) {
+			active = &keys[i]
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.active = active
+	return nil
+}
+
+func (k *KeySet) unseal(s storage.SigningKey) (crypto.Signer, error) {
+	raw, err := cryptutils.Open(k.sealKey, s.SealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unsealing key: %w", err)
+	}
+	return cryptutils.ParsePrivateKey(raw)
+}
+
+// prune deletes all retired keys whose tokens have expired
+func (k *KeySet) prune(ctx context.Context) error {
+	stored, err := k.store.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	imported := lastImported(stored)
+	for _, key := range stored {
+		if expired(key, now) {
+			if err := k.deleteExpired(ctx, key, imported); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteExpired deletes a retired key whose tokens have expired. The last imported key is kept
+// without its private part, so init does not import the configured key again.
+func (k *KeySet) deleteExpired(ctx context.Context, key storage.SigningKey, imported string) error {
+	if key.ID != imported {
+		log.Info().Str("kid", key.ID).Msg("deleting retired signing key")
+		return k.store.DeleteSigningKey(ctx, key.ID)
+	}
+	if key.SealedKey == "" {
+		return nil
+	}
+	log.Info().Str("kid", key.ID).Msg("deleting retired signing key, keeping its import")
+	key.SealedKey = ""
+	return k.store.UpdateSigningKey(ctx, key)
+}
+
+// lastImported returns the id of the most recently imported key of the stored keys
+func lastImported(stored []storage.SigningKey) string {
+	var kid string
+	var created time.Time
+	for _, key := range stored {
+		if key.Imported && !key.CreatedAt.Before(created) {
+			kid, created = key.ID, key.CreatedAt
+		}
+	}
+	return kid
+}
+
+func expired(key storage.SigningKey, now time.Time) bool {
+	return key.State == storage.KeyStateRetired && key.RetireAt.Before(now)
+}
+
+func (k *KeySet) usable(s storage.SigningKey) bool {
+	_, err := k.unseal(s)
+	return err == nil
+}
+
+func (k *KeySet) known(kid string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KeySet) hasNext() bool {
+	for _, key := range k.keys {
+		if key.State == storage.KeyStateNext {
+			return true
+		}
+	}
+	return false
+}
+
+// SigningKey returns the active key including its key id, which is used by fosite to sign tokens
+func (k *KeySet) SigningKey(_ context.Context) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == nil {
+		return nil, errors.New("no active signing key")
+	}
+	return &jose.JSONWebKey{
+		Algorithm: string(k.active.alg),
+		KeyID:     k.active.ID,
+		Use:       "sig",
+		Key:       k.active.private,
+	}, nil
+}
+
+// Public returns the public part of all published keys
+func (k *KeySet) Public() *jose.JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	for _, key := range k.keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Algorithm: string(key.alg),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Key:       key.private.Public(),
+		})
+	}
+	return jwks
+}
+
+// Algorithms returns the signing algorithms of all published keys
+func (k *KeySet) Algorithms() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	algs := []string{}
+	seen := map[jose.SignatureAlgorithm]bool{}
+	for _, key := range k.keys {
+		if !seen[key.alg] {
+			seen[key.alg] = true
+			algs = append(algs, string(key.alg))
+		}
+	}
+	return algs
+}
+
+// info describes all published keys without their private parts
+func (k *KeySet) info() []adminKeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]adminKeyInfo, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, adminKeyInfo{
+			KeyID:       key.ID,
+			Algorithm:   string(key.alg),
+			State:       key.State,
+			CreatedAt:   key.CreatedAt.Unix(),
+			ActivatedAt: unixOrZero(key.ActivatedAt),
+			RetireAt:    unixOrZero(key.RetireAt),
+		})
+	}
+	return keys
+}
+
+// verificationKey returns the public key with the given key id
+func (k *KeySet) verificationKey(kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key.private.Public(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (k *KeySet) activeAlgorithm() jose.SignatureAlgorithm {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == nil {
+		return jose.RS256
+	}
+	return k.active.alg
+}
+
+// run periodically reloads the keys from the storage, so rotations done by other
+// instances are picked up, and rotates the keys if the active key is older than the interval
+func (k *KeySet) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := k.prune(ctx); err != nil {
+			log.Warn().Err(err).Msg("pruning retired signing keys")
+		}
+		if err := k.load(ctx); err != nil {
+			log.Warn().Err(err).Msg("reloading signing keys")
+			continue
+		}
+		k.mu.RLock()
+		due := k.interval > 0 && (k.active == nil || time.Since(k.active.ActivatedAt) > k.interval)
+		k.mu.RUnlock()
+		if due {
+			if err := k.Rotate(ctx); err != nil {
+				log.Error().Err(err).Msg("scheduled signing key rotation failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"testing"
+
+	"github.com/parkour-vienna/distrust/cryptutils"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+func TestConfiguredKeyImport(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.Open(storage.Config{Driver: "memory"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := cryptutils.KeySpec{Type: "ec", Bits: 256}
+	generate := func() crypto.Signer {
+		priv, err := spec.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return priv
+	}
+	// start simulates a restart of distrust with the configured key
+	start := func(configured crypto.Signer) *KeySet {
+		k := NewKeySet(store, []byte("some-exactly-32-byte-long-secret"), spec, 0)
+		// tokens expire immediately, so retired keys are pruned on the next rotation
+		k.retain = 0
+		if err := k.init(ctx, configured); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	activeKid := func(k *KeySet) string {
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		return k.active.ID
+	}
+
+	configured := generate()
+	kid := cryptutils.KeyID(configured.Public())
+	k := start(configured)
+	if activeKid(k) != kid {
+		t.Fatal("configured key was not activated")
+	}
+	if k = start(configured); activeKid(k) != kid {
+		t.Fatal("configured key was not kept on restart")
+	}
+
+	// rotate the configured key out until it is pruned
+	for i := 0; i < 2; i++ {
+		if err := k.Rotate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k.known(kid) {
+		t.Fatal("configured key was not pruned")
+	}
+	rotated := activeKid(k)
+	if k = start(configured); activeKid(k) != rotated {
+		t.Fatal("pruned configured key was activated again on restart")
+	}
+	stored, err := store.ListSigningKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range stored {
+		if key.ID == kid && key.SealedKey != "" {
+			t.Error("private part of the pruned key is still stored")
+		}
+	}
+
+	// a new configured key is imported, and the old one again once it is configured back
+	replacement := generate()
+	if k = start(replacement); activeKid(k) != cryptutils.KeyID(replacement.Public()) {
+		t.Fatal("new configured key was not activated")
+	}
+	if k = start(configured); activeKid(k) != kid {
+		t.Fatal("reconfigured key was not activated")
+	}
+}
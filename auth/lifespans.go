@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+const (
+	// maxIDTokenLifespan limits the lifespan of id tokens. Retired signing keys are published at least this long.
+	maxIDTokenLifespan = time.Hour * 24
+	// maxAuthorizeCodeLifespan limits the lifespan of authorization codes. fosite expires all codes
+	// after this time, shorter lifespans are enforced by the token endpoint.
+	maxAuthorizeCodeLifespan = time.Hour
+)
+
+// Lifespans configures how long tokens and logins are valid. Zero values of a client fall
+// back to the global lifespans.
+type Lifespans struct {
+	AccessToken   time.Duration
+	IDToken       time.Duration
+	RefreshToken  time.Duration
+	AuthorizeCode time.Duration
+	// Session limits how long a login can be kept alive by refreshing tokens, zero is unlimited
+	Session time.Duration
+	// RefreshTokenRotation invalidates refresh tokens once they are used, it is enabled if not set
+	RefreshTokenRotation *bool
+}
+
+// DefaultLifespans are used for lifespans which are not configured
+var DefaultLifespans = Lifespans{
+	AccessToken:   time.Minute * 30,
+	IDToken:       time.Hour * 6,
+	RefreshToken:  time.Hour * 24 * 30,
+	AuthorizeCode: time.Minute * 15,
+}
+
+// Validate checks that no lifespan is negative or exceeds its limit
+func (l Lifespans) Validate() error {
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"access token", l.AccessToken},
+		{"id token", l.IDToken},
+		{"refresh token", l.RefreshToken},
+		{"authorize code", l.AuthorizeCode},
+		{"session", l.Session},
+	} {
+		if f.d < 0 {
+			return fmt.Errorf("%s lifespan can not be negative", f.name)
+		}
+	}
+	if l.IDToken > maxIDTokenLifespan {
+		return fmt.Errorf("id token lifespan can not exceed %s", maxIDTokenLifespan)
+	}
+	if l.AuthorizeCode > maxAuthorizeCodeLifespan {
+		return fmt.Errorf("authorize code lifespan can not exceed %s", maxAuthorizeCodeLifespan)
+	}
+	if l.Session != 0 && l.AccessToken > l.Session {
+		return errors.New("access token lifespan can not exceed the session lifespan")
+	}
+	return nil
+}
+
+// merge returns l with the lifespans set in client
+func (l Lifespans) merge(client Lifespans) Lifespans {
+	for _, f := range []struct{ global, client *time.Duration }{
+		{&l.AccessToken, &client.AccessToken},
+		{&l.IDToken, &client.IDToken},
+		{&l.RefreshToken, &client.RefreshToken},
+		{&l.AuthorizeCode, &client.AuthorizeCode},
+		{&l.Session, &client.Session},
+	} {
+		if *f.client != 0 {
+			*f.global = *f.client
+		}
+	}
+	if client.RefreshTokenRotation != nil {
+		l.RefreshTokenRotation = client.RefreshTokenRotation
+	}
+	return l
+}
+
+// rotate reports whether used refresh tokens are invalidated
+func (l Lifespans) rotate() bool {
+	return l.RefreshTokenRotation == nil || *l.RefreshTokenRotation
+}
+
+// lifespansJSON is the representation of Lifespans in the admin api and the storage
+type lifespansJSON struct {
+	AccessToken          string `json:"access_token,omitempty"`
+	IDToken              string `json:"id_token,omitempty"`
+	RefreshToken         string `json:"refresh_token,omitempty"`
+	AuthorizeCode        string `json:"authorize_code,omitempty"`
+	Session              string `json:"session,omitempty"`
+	RefreshTokenRotation *bool  `json:"refresh_token_rotation,omitempty"`
+}
+
+func (l Lifespans) MarshalJSON() ([]byte, error) {
+	format := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return d.String()
+	}
+	return json.Marshal(lifespansJSON{
+		AccessToken:          format(l.AccessToken),
+		IDToken:              format(l.IDToken),
+		RefreshToken:         format(l.RefreshToken),
+		AuthorizeCode:        format(l.AuthorizeCode),
+		Session:              format(l.Session),
+		RefreshTokenRotation: l.RefreshTokenRotation,
+	})
+}
+
+func (l *Lifespans) UnmarshalJSON(data []byte) error {
+	var lj lifespansJSON
+	if err := json.Unmarshal(data, &lj); err != nil {
+		return err
+	}
+	parsed := Lifespans{RefreshTokenRotation: lj.RefreshTokenRotation}
+	for _, f := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"access_token", lj.AccessToken, &parsed.AccessToken},
+		{"id_token", lj.IDToken, &parsed.IDToken},
+		{"refresh_token", lj.RefreshToken, &parsed.RefreshToken},
+		{"authorize_code", lj.AuthorizeCode, &parsed.AuthorizeCode},
+		{"session", lj.Session, &parsed.Session},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return fmt.Errorf("lifespan %s: %w", f.name, err)
+		}
+		*f.d = d
+	}
+	*l = parsed
+	return nil
+}
+
+// GetEffectiveLifespan implements fosite.ClientWithCustomTokenLifespans, the
+// lifespans of the client are the same for all grant types
+func (c *DistrustClient) GetEffectiveLifespan(gt fosite.GrantType, tt fosite.TokenType, fallback time.Duration) time.Duration {
+	var d time.Duration
+	switch tt {
+	case fosite.AccessToken:
+		d = c.Lifespans.AccessToken
+	case fosite.IDToken:
+		d = c.Lifespans.IDToken
+	case fosite.RefreshToken:
+		d = c.Lifespans.RefreshToken
+	}
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
+
+// clientLifespans returns the global lifespans overridden by the lifespans of the client
+func (o *OIDCProvider) clientLifespans(client fosite.Client) Lifespans {
+	if dc, ok := client.(*DistrustClient); ok {
+		return o.lifespans.merge(dc.Lifespans)
+	}
+	return o.lifespans
+}
+
+// checkLifespans rejects expired authorization codes and logins of the access request. Access
+// and refresh tokens are shortened so they do not outlive the login.
+func (o *OIDCProvider) checkLifespans(ar fosite.AccessRequester) error {
+	session, ok := ar.GetSession().(*openid.DefaultSession)
+	if !ok || session.Claims == nil {
+		return nil
+	}
+	lifespans := o.clientLifespans(ar.GetClient())
+	now := time.Now().UTC()
+	if ar.GetGrantTypes().ExactOne("authorization_code") {
+		issued := session.GetExpiresAt(fosite.AuthorizeCode).Add(-maxAuthorizeCodeLifespan)
+		if now.After(issued.Add(lifespans.AuthorizeCode)) {
+			return fosite.ErrInvalidGrant.WithHint("The authorization code has expired.")
+		}
+	}
+	if lifespans.Session == 0 || session.Claims.AuthTime.IsZero() {
+		return nil
+	}
+	end := session.Claims.AuthTime.Add(lifespans.Session)
+	if now.After(end) {
+		return fosite.ErrInvalidGrant.WithHint("The login has expired, the user has to sign in again.")
+	}
+	for _, tt := range []fosite.TokenType{fosite.AccessToken, fosite.RefreshToken} {
+		if session.GetExpiresAt(tt).After(end) {
+			session.SetExpiresAt(tt, end)
+		}
+	}
+	return nil
+}
+
+type keepRefreshTokenKey struct{}
+
+// keepRefreshToken marks the token request in ctx to not invalidate the used refresh token
+func keepRefreshToken(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keepRefreshTokenKey{}, true)
+}
+
+// rotationStore is the storage used by fosite. It keeps used refresh tokens valid for clients
+// which disabled refresh token rotation. fosite still issues a new refresh token on every refresh,
+// so these clients collect valid refresh tokens until they expire or are revoked.
+type rotationStore struct {
+	storage.Storage
+}
+
+func (s rotationStore) RotateRefreshToken(ctx context.Context, requestID string, refreshTokenSignature string) error {
+	if keep, _ := ctx.Value(keepRefreshTokenKey{}).(bool); keep {
+		return s.RevokeAccessToken(ctx, requestID)
+	}
+	return s.Storage.RotateRefreshToken(ctx, requestID, refreshTokenSignature)
+}
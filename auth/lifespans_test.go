@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+)
+
+func TestLifespansJSON(t *testing.T) {
+	disabled := false
+	l := Lifespans{AccessToken: 5 * time.Minute, Session: 36 * time.Hour, RefreshTokenRotation: &disabled}
+	raw, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"access_token":"5m0s","session":"36h0m0s","refresh_token_rotation":false}`; string(raw) != want {
+		t.Errorf("got %s, want %s", raw, want)
+	}
+	var parsed Lifespans
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.AccessToken != l.AccessToken || parsed.Session != l.Session || parsed.RefreshTokenRotation == nil || *parsed.RefreshTokenRotation {
+		t.Errorf("round trip changed the lifespans to %+v", parsed)
+	}
+
+	if err := json.Unmarshal([]byte(`{"id_token":"90m","refresh_token":"720h"}`), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed != (Lifespans{IDToken: 90 * time.Minute, RefreshToken: 720 * time.Hour}) {
+		t.Errorf("parsing replaced the lifespans with %+v", parsed)
+	}
+	for _, invalid := range []string{`{"access_token":"30"}`, `{"session":"1 day"}`, `{"id_token":6}`} {
+		if err := json.Unmarshal([]byte(invalid), &parsed); err == nil {
+			t.Errorf("invalid lifespans %s were parsed", invalid)
+		}
+	}
+}
+
+func TestLifespansMerge(t *testing.T) {
+	disabled := false
+	merged := DefaultLifespans.merge(Lifespans{AccessToken: time.Minute, RefreshTokenRotation: &disabled})
+	if merged.AccessToken != time.Minute || merged.IDToken != DefaultLifespans.IDToken || merged.rotate() {
+		t.Errorf("got merged lifespans %+v", merged)
+	}
+	if !DefaultLifespans.rotate() {
+		t.Error("rotation is disabled by default")
+	}
+}
+
+func TestCheckLifespans(t *testing.T) {
+	o, _ := newTestProvider(t, "https://discourse.example.com", map[string]fosite.Client{}, WithLifespans(DefaultLifespans))
+	client := &DistrustClient{Lifespans: Lifespans{Session: time.Hour}}
+	refresh := func(authTime time.Time) (*openid.DefaultSession, error) {
+		session := &openid.DefaultSession{Claims: &jwt.IDTokenClaims{AuthTime: authTime}}
+		now := time.Now().UTC()
+		session.SetExpiresAt(fosite.AccessToken, now.Add(DefaultLifespans.AccessToken))
+		session.SetExpiresAt(fosite.RefreshToken, now.Add(DefaultLifespans.RefreshToken))
+		ar := fosite.NewAccessRequest(session)
+		ar.Client = client
+		ar.GrantTypes = fosite.Arguments{"refresh_token"}
+		return session, o.checkLifespans(ar)
+	}
+
+	if _, err := refresh(time.Now().Add(-2 * time.Hour)); !errors.Is(err, fosite.ErrInvalidGrant) {
+		t.Errorf("refresh after the end of the session: got %v", err)
+	}
+
+	authTime := time.Now().Add(-50 * time.Minute).UTC()
+	session, err := refresh(authTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := authTime.Add(time.Hour)
+	for _, tt := range []fosite.TokenType{fosite.AccessToken, fosite.RefreshToken} {
+		if !session.GetExpiresAt(tt).Equal(end) {
+			t.Errorf("%s expires at %s, want the end of the session at %s", tt, session.GetExpiresAt(tt), end)
+		}
+	}
+
+	// without session lifespan, logins do not expire
+	client.Lifespans = Lifespans{}
+	if _, err := refresh(time.Now().Add(-24 * 365 * time.Hour)); err != nil {
+		t.Errorf("refresh of an old login without session lifespan: %v", err)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	disabled := false
+	for _, tc := range []struct {
+		name     string
+		rotation *bool
+	}{
+		{"rotation", nil},
+		{"no rotation", &disabled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			disc := newDiscourseStub(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+			_, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+				"test": &DistrustClient{
+					DefaultClient: fosite.DefaultClient{
+						ID:            "test",
+						Public:        true,
+						RedirectURIs:  []string{"https://rp.example.com/cb"},
+						ResponseTypes: []string{"code"},
+						GrantTypes:    []string{"authorization_code", "refresh_token"},
+						Scopes:        []string{"openid", "offline_access"},
+					},
+					Lifespans: Lifespans{RefreshTokenRotation: tc.rotation},
+				},
+			})
+			loc := authorize(t, newBrowser(t, srv, disc), srv, url.Values{
+				"client_id":             {"test"},
+				"response_type":         {"code"},
+				"scope":                 {"openid offline_access"},
+				"redirect_uri":          {"https://rp.example.com/cb"},
+				"state":                 {"some-state-value"},
+				"nonce":                 {"some-nonce-value"},
+				"code_challenge":        {pkceVerifier},
+				"code_challenge_method": {"plain"},
+			})
+			body := exchangeCode(t, srv, "test", "", url.Values{
+				"code":          {loc.Query().Get("code")},
+				"redirect_uri":  {"https://rp.example.com/cb"},
+				"code_verifier": {pkceVerifier},
+			})
+			first, _ := body["refresh_token"].(string)
+			if first == "" {
+				t.Fatalf("no refresh token issued: %v", body)
+			}
+			refresh := func(token string) (int, string) {
+				t.Helper()
+				form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}, "client_id": {"test"}}
+				resp, err := http.Post(srv.URL+"/oauth2/token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body := map[string]interface{}{}
+				_ = json.NewDecoder(resp.Body).Decode(&body)
+				next, _ := body["refresh_token"].(string)
+				return resp.StatusCode, next
+			}
+
+			status, second := refresh(first)
+			if status != http.StatusOK || second == "" || second == first {
+				t.Fatalf("refresh: got %d with refresh token %q", status, second)
+			}
+			status, third := refresh(first)
+			if tc.rotation == nil {
+				if status == http.StatusOK {
+					t.Fatal("used refresh token was accepted again")
+				}
+				// reusing a rotated token revokes the whole login
+				if status, _ := refresh(second); status == http.StatusOK {
+					t.Error("refresh token of a reused login is still valid")
+				}
+				return
+			}
+			if status != http.StatusOK || third == "" {
+				t.Fatalf("reusing the refresh token without rotation: got %d", status)
+			}
+			// the refresh tokens issued meanwhile are valid as well
+			for _, token := range []string{second, third, first} {
+				if status, _ := refresh(token); status != http.StatusOK {
+					t.Errorf("refresh token without rotation was rejected: %d", status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/ory/fosite/token/jwt"
+	"github.com/parkour-vienna/distrust/audit"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxExpiredHintAge limits how long after their expiry id tokens are accepted as id_token_hint
+	maxExpiredHintAge = time.Hour * 24
+	// logoutCookie binds the logout confirmation to the browser it was shown to
+	logoutCookie          = "distrust_logout"
+	logoutConfirmLifetime = time.Minute * 10
+)
+
+// logoutEndpoint implements OpenID Connect RP-Initiated Logout 1.0
+func (o *OIDCProvider) logoutEndpoint(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if err := req.ParseForm(); err != nil {
+		writeLogoutError(rw, err)
+		return
+	}
+	clientID := req.Form.Get("client_id")
+	redirect := req.Form.Get("post_logout_redirect_uri")
+
+	var subject, sid string
+	if hint := req.Form.Get("id_token_hint"); hint != "" {
+		claims, err := o.decodeIDTokenHint(ctx, hint, o.getAuthRoot(req))
+		if err != nil {
+			log.Warn().Err(err).Msg("invalid id token hint")
+			writeLogoutError(rw, errors.New("invalid id_token_hint"))
+			return
+		}
+		subject, _ = claims["sub"].(string)
+		sid, _ = claims["sid"].(string)
+		audience := audienceList(claims["aud"])
+		switch {
+		case clientID == "" && len(audience) == 1:
+			clientID = audience[0]
+		case clientID != "" && !slices.Contains(audience, clientID):
+			writeLogoutError(rw, errors.New("client_id does not match id_token_hint"))
+			return
+		}
+	}
+
+	if redirect != "" {
+		if err := o.validatePostLogoutRedirect(ctx, clientID, redirect); err != nil {
+			log.Warn().Err(err).Str("client", clientID).Str("redirect", redirect).Msg("invalid post logout redirect")
+			writeLogoutError(rw, err)
+			return
+		}
+	}
+
+	// without hint, the user of the browser's sso session is logged out
+	sso, err := o.getSSOSession(ctx, req)
+	if err == nil && subject == "" {
+		subject, sid = sso.Values.Get("external_id"), sso.SessionID
+	}
+
+	// revoking all tokens of the hinted user requires that the browser is logged in as them or that
+	// the user confirmed the logout, so links to the logout endpoint can not log out other users
+	if subject != "" && !(sso != nil && sso.Values.Get("external_id") == subject) && !o.logoutConfirmed(rw, req) {
+		o.confirmLogout(rw, req)
+		return
+	}
+
+	if subject != "" {
+		o.logoutSubject(ctx, subject)
+	}
+	o.clearSSOSession(rw, req)
+	o.audit.Log(req, audit.Event{Type: audit.Logout, CorrelationID: sid, ClientID: clientID, Subject: subject})
+
+	if redirect == "" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(rw, "You have been logged out")
+		return
+	}
+	target, _ := url.Parse(redirect)
+	if state := req.Form.Get("state"); state != "" {
+		q := target.Query()
+		q.Set("state", state)
+		target.RawQuery = q.Encode()
+	}
+	http.Redirect(rw, req, target.String(), http.StatusFound)
+}
+
+// logoutSubject revokes all tokens of a subject, notifies the clients they signed into
+// and optionally ends their discourse sessions
+func (o *OIDCProvider) logoutSubject(ctx context.Context, subject string) {
+	log.Info().Str("subject", subject).Msg("logging out user")
+	if err := o.store.RevokeSubject(ctx, subject); err != nil {
+		log.Error().Err(err).Str("subject", subject).Msg("revoking tokens")
+	}
+	o.backchannelLogout(ctx, subject)
+	if o.discourseLogout && o.discourseAPI != nil {
+		if err := o.discourseAPI.LogOut(ctx, subject); err != nil {
+			log.Error().Err(err).Str("subject", subject).Msg("logging out of discourse")
+		}
+	}
+}
+
+func (o *OIDCProvider) validatePostLogoutRedirect(ctx context.Context, clientID, redirect string) error {
+	if clientID == "" {
+		return errors.New("post_logout_redirect_uri requires client_id or id_token_hint")
+	}
+	client, err := o.store.GetClient(ctx, clientID)
+	if err != nil {
+		return fmt.Errorf("unknown client %s", clientID)
+	}
+	dc, ok := client.(*DistrustClient)
+	if !ok || !slices.Contains(dc.PostLogoutRedirectURIs, redirect) {
+		return errors.New("post_logout_redirect_uri is not registered for this client")
+	}
+	return nil
+}
+
+// logoutConfirmed reports whether the user confirmed the logout with the form of confirmLogout
+func (o *OIDCProvider) logoutConfirmed(rw http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	cookie, err := req.Cookie(logoutCookie)
+	if err != nil {
+		return false
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     logoutCookie,
+		Path:     o.root,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteStrictMode,
+	})
+	token := req.PostForm.Get("confirm")
+	return token != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+// confirmLogout asks the user to confirm the logout. The form is only accepted together with a
+// strict same site cookie, so other sites can not submit it.
+func (o *OIDCProvider) confirmLogout(rw http.ResponseWriter, req *http.Request) {
+	token := randomToken()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     logoutCookie,
+		Value:    token,
+		Path:     o.root,
+		MaxAge:   int(logoutConfirmLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteStrictMode,
+	})
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	err := logoutTemplate.Execute(rw, map[string]string{
+		"Action":   o.getAuthRoot(req) + "/logout",
+		"Hint":     req.Form.Get("id_token_hint"),
+		"ClientID": req.Form.Get("client_id"),
+		"Redirect": req.Form.Get("post_logout_redirect_uri"),
+		"State":    req.Form.Get("state"),
+		"Confirm":  token,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("rendering logout confirmation")
+	}
+}
+
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Log out</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<p>Do you want to log out of all applications?</p>
+<input type="hidden" name="id_token_hint" value="{{.Hint}}">
+{{if .ClientID}}<input type="hidden" name="client_id" value="{{.ClientID}}">{{end}}
+{{if .Redirect}}<input type="hidden" name="post_logout_redirect_uri" value="{{.Redirect}}">{{end}}
+{{if .State}}<input type="hidden" name="state" value="{{.State}}">{{end}}
+<input type="hidden" name="confirm" value="{{.Confirm}}">
+<button type="submit">Log out</button>
+</form>
+</body>
+</html>
+`))
+
+// decodeIDTokenHint verifies an id token previously issued by distrust. Tokens which expired
+// less than maxExpiredHintAge ago are accepted.
+func (o *OIDCProvider) decodeIDTokenHint(ctx context.Context, hint, issuer string) (jwt.MapClaims, error) {
+	token, err := o.signer.Decode(ctx, hint)
+	var ve *jwt.ValidationError
+	if err != nil && !(errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired) {
+		return nil, err
+	}
+	if !token.Claims.VerifyExpiresAt(time.Now().Add(-maxExpiredHintAge).Unix(), true) {
+		return nil, errors.New("id token expired too long ago")
+	}
+	if iss, _ := token.Claims["iss"].(string); iss != issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	return token.Claims, nil
+}
+
+func writeLogoutError(rw http.ResponseWriter, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
+
+func audienceList(aud interface{}) []string {
+	switch a := aud.(type) {
+	case string:
+		return []string{a}
+	case []string:
+		return a
+	case []interface{}:
+		r := []string{}
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				r = append(r, s)
+			}
+		}
+		return r
+	}
+	return nil
+}
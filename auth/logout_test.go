@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/storage"
+)
+
+// logoutTest is a provider with a stubbed discourse api counting the logouts of user 42
+type logoutTest struct {
+	o          *OIDCProvider
+	srv        *httptest.Server
+	logouts    atomic.Int32
+	noRedirect *http.Client
+}
+
+func newLogoutTest(t *testing.T) *logoutTest {
+	lt := &logoutTest{}
+	disc := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost && req.URL.Path == "/admin/users/42/log_out.json" && req.Header.Get("Api-Key") == "key" {
+			lt.logouts.Add(1)
+			_, _ = io.WriteString(rw, `{"success":"OK"}`)
+			return
+		}
+		http.NotFound(rw, req)
+	}))
+	t.Cleanup(disc.Close)
+	clients := map[string]fosite.Client{
+		"test": &DistrustClient{
+			DefaultClient: fosite.DefaultClient{
+				ID:            "test",
+				RedirectURIs:  []string{"https://rp.example.com/cb"},
+				ResponseTypes: []string{"code"},
+				GrantTypes:    []string{"authorization_code"},
+				Scopes:        []string{"openid"},
+			},
+			PostLogoutRedirectURIs: []string{"https://rp.example.com/bye"},
+		},
+	}
+	lt.o, lt.srv = newTestProvider(t, disc.URL, clients,
+		WithDiscourseAPI(discourse.NewAPIClient(disc.URL, "key", "system")),
+		WithDiscourseLogout(true),
+		WithSSOSession(time.Hour),
+	)
+	lt.noRedirect = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	if err := lt.o.store.CreateLogin(context.Background(), storage.Login{
+		SessionID: "session",
+		ClientID:  "test",
+		Subject:   "42",
+		Issuer:    lt.issuer(),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return lt
+}
+
+func (lt *logoutTest) issuer() string {
+	return lt.srv.URL + "/oauth2"
+}
+
+func (lt *logoutTest) loggedIn(t *testing.T) bool {
+	logins, err := lt.o.store.ListLogins(context.Background(), "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(logins) > 0
+}
+
+// ssoCookie returns an sso session cookie of subject for the login "session"
+func (lt *logoutTest) ssoCookie(t *testing.T, subject string) *http.Cookie {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, lt.issuer()+"/auth", nil)
+	values := url.Values{"external_id": {subject}, "username": {"alice"}}
+	if err := lt.o.setSSOSession(rec, req, values, "session", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+func (lt *logoutTest) get(t *testing.T, query url.Values, cookies ...*http.Cookie) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, lt.issuer()+"/logout?"+query.Encode(), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := lt.noRedirect.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestLogoutWithSSOSession(t *testing.T) {
+	lt := newLogoutTest(t)
+	hint := testIDToken(t, lt.o, lt.issuer(), "42", time.Now().Add(time.Hour))
+
+	resp := lt.get(t, url.Values{
+		"id_token_hint":            {hint},
+		"post_logout_redirect_uri": {"https://rp.example.com/bye"},
+		"state":                    {"xyz"},
+	}, lt.ssoCookie(t, "42"))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status %d, want a redirect", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "https://rp.example.com/bye?state=xyz" {
+		t.Errorf("redirected to %s", loc)
+	}
+	if lt.logouts.Load() != 1 {
+		t.Errorf("%d discourse logouts, want 1", lt.logouts.Load())
+	}
+	if lt.loggedIn(t) {
+		t.Error("login was not deleted")
+	}
+}
+
+func TestLogoutRequiresConfirmation(t *testing.T) {
+	lt := newLogoutTest(t)
+	hint := testIDToken(t, lt.o, lt.issuer(), "42", time.Now().Add(time.Hour))
+
+	// a link without sso session of the user only shows the confirmation
+	resp := lt.get(t, url.Values{"id_token_hint": {hint}}, lt.ssoCookie(t, "7"))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<form") {
+		t.Fatalf("status %d, want the confirmation form", resp.StatusCode)
+	}
+	if lt.logouts.Load() != 0 || !lt.loggedIn(t) {
+		t.Fatal("logged out without confirmation")
+	}
+	match := regexp.MustCompile(`name="confirm" value="([^"]+)"`).FindStringSubmatch(string(body))
+	if match == nil {
+		t.Fatal("confirmation token missing")
+	}
+	var confirmCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == logoutCookie {
+			confirmCookie = c
+		}
+	}
+	if confirmCookie == nil || confirmCookie.SameSite != http.SameSiteStrictMode {
+		t.Fatal("strict confirmation cookie missing")
+	}
+
+	post := func(cookies ...*http.Cookie) *http.Response {
+		form := url.Values{"id_token_hint": {hint}, "confirm": {match[1]}}
+		req, _ := http.NewRequest(http.MethodPost, lt.issuer()+"/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := lt.noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// other sites can submit the form, but the strict cookie is not sent along
+	post()
+	if lt.logouts.Load() != 0 || !lt.loggedIn(t) {
+		t.Fatal("logged out without confirmation cookie")
+	}
+
+	if resp := post(confirmCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d after confirming", resp.StatusCode)
+	}
+	if lt.logouts.Load() != 1 {
+		t.Errorf("%d discourse logouts, want 1", lt.logouts.Load())
+	}
+	if lt.loggedIn(t) {
+		t.Error("login was not deleted")
+	}
+}
+
+func TestLogoutRejectsOldHints(t *testing.T) {
+	lt := newLogoutTest(t)
+	hint := testIDToken(t, lt.o, lt.issuer(), "42", time.Now().Add(-maxExpiredHintAge-time.Minute))
+
+	resp := lt.get(t, url.Values{"id_token_hint": {hint}}, lt.ssoCookie(t, "42"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	if lt.logouts.Load() != 0 || !lt.loggedIn(t) {
+		t.Fatal("logged out with an old hint")
+	}
+
+	recent := testIDToken(t, lt.o, lt.issuer(), "42", time.Now().Add(-time.Hour))
+	if resp := lt.get(t, url.Values{"id_token_hint": {recent}}, lt.ssoCookie(t, "42")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d for a recently expired hint", resp.StatusCode)
+	}
+	if lt.logouts.Load() != 1 {
+		t.Errorf("%d discourse logouts, want 1", lt.logouts.Load())
+	}
+}
+
+func TestLogoutWithoutHint(t *testing.T) {
+	lt := newLogoutTest(t)
+	cookie := lt.ssoCookie(t, "42")
+
+	resp := lt.get(t, url.Values{}, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if lt.logouts.Load() != 1 {
+		t.Errorf("%d discourse logouts, want 1", lt.logouts.Load())
+	}
+	if lt.loggedIn(t) {
+		t.Error("login was not deleted")
+	}
+	// a copy of the cookie does not restore the session
+	req := httptest.NewRequest(http.MethodGet, lt.issuer()+"/auth", nil)
+	req.AddCookie(cookie)
+	if _, err := lt.o.getSSOSession(context.Background(), req); err == nil {
+		t.Error("sso session still valid after logout")
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/ory/fosite"
+)
+
+// PKCEPolicy controls whether clients need to use Proof Key for Code Exchange (RFC 7636)
+type PKCEPolicy string
+
+const (
+	// PKCEOptional validates PKCE if the client sends a code challenge
+	PKCEOptional PKCEPolicy = "optional"
+	// PKCERequired rejects authorization code requests without a code challenge
+	PKCERequired PKCEPolicy = "required"
+	// PKCES256Only requires a code challenge using the S256 method
+	PKCES256Only PKCEPolicy = "s256-only"
+)
+
+// Validate checks that the policy is known. The empty policy uses the global default.
+func (p PKCEPolicy) Validate() error {
+	switch p {
+	case "", PKCEOptional, PKCERequired, PKCES256Only:
+		return nil
+	}
+	return fmt.Errorf("unknown pkce policy %q", p)
+}
+
+// pkcePolicy returns the policy for the client. Public clients can not keep their authorization
+// codes confidential, so they always need PKCE.
+func (o *OIDCProvider) pkcePolicy(client fosite.Client) PKCEPolicy {
+	policy := o.pkce
+	if dc, ok := client.(*DistrustClient); ok && dc.PKCE != "" {
+		policy = dc.PKCE
+	}
+	if policy == "" || policy == PKCEOptional {
+		if client.IsPublic() {
+			return PKCERequired
+		}
+		return PKCEOptional
+	}
+	return policy
+}
+
+// checkPKCE enforces the pkce policy of the client on authorization requests issuing a code.
+// The challenge itself is validated by fosite, which also rejects code verifiers sent for codes
+// issued without a challenge.
+func (o *OIDCProvider) checkPKCE(ar fosite.AuthorizeRequester) error {
+	if !ar.GetResponseTypes().Has("code") {
+		return nil
+	}
+	challenge := ar.GetRequestForm().Get("code_challenge")
+	method := ar.GetRequestForm().Get("code_challenge_method")
+	switch o.pkcePolicy(ar.GetClient()) {
+	case PKCERequired:
+		if challenge == "" {
+			return fosite.ErrInvalidRequest.WithHint("This client must include a code_challenge when performing the authorize code flow.")
+		}
+	case PKCES256Only:
+		if challenge == "" || method != "S256" {
+			return fosite.ErrInvalidRequest.WithHint("This client must include a code_challenge using code_challenge_method=S256.")
+		}
+	}
+	return nil
+}
+
+// codeChallengeMethods returns the methods advertised in the discovery document
+func (o *OIDCProvider) codeChallengeMethods() []string {
+	if o.pkce == PKCES256Only {
+		return []string{"S256"}
+	}
+	return []string{"S256", "plain"}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	pkceRedirect = "https://rp.example.com/cb"
+	pkceVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-this-is-long-enough"
+)
+
+func newPKCETest(t *testing.T) (*httptest.Server, *httptest.Server) {
+	t.Helper()
+	secret, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := func(id string, public bool, policy PKCEPolicy) *DistrustClient {
+		c := &DistrustClient{
+			DefaultClient: fosite.DefaultClient{
+				ID:            id,
+				Public:        public,
+				RedirectURIs:  []string{pkceRedirect},
+				ResponseTypes: []string{"code"},
+				GrantTypes:    []string{"authorization_code"},
+				Scopes:        []string{"openid"},
+			},
+			PKCE: policy,
+		}
+		if !public {
+			c.Secret = secret
+		}
+		return c
+	}
+	disc := newDiscourseStub(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+	_, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"optional": client("optional", false, PKCEOptional),
+		"required": client("required", false, PKCERequired),
+		"s256":     client("s256", false, PKCES256Only),
+		"public":   client("public", true, ""),
+	})
+	return srv, disc
+}
+
+func pkceAuthorize(t *testing.T, srv, disc *httptest.Server, clientID string, challenge url.Values) *url.URL {
+	t.Helper()
+	query := url.Values{
+		"client_id":     {clientID},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"redirect_uri":  {pkceRedirect},
+		"state":         {"some-state-value"},
+		"nonce":         {"some-nonce-value"},
+	}
+	for k, v := range challenge {
+		query[k] = v
+	}
+	return authorize(t, newBrowser(t, srv, disc), srv, query)
+}
+
+func s256Challenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func TestPKCEAuthorizeDowngrades(t *testing.T) {
+	srv, disc := newPKCETest(t)
+	for _, tc := range []struct {
+		name      string
+		client    string
+		challenge url.Values
+		rejected  bool
+	}{
+		{"optional without challenge", "optional", nil, false},
+		{"required without challenge", "required", nil, true},
+		{"required with plain", "required", url.Values{"code_challenge": {pkceVerifier}, "code_challenge_method": {"plain"}}, false},
+		{"s256-only without challenge", "s256", nil, true},
+		{"s256-only with plain", "s256", url.Values{"code_challenge": {pkceVerifier}, "code_challenge_method": {"plain"}}, true},
+		{"s256-only without method", "s256", url.Values{"code_challenge": {pkceVerifier}}, true},
+		{"s256-only with S256", "s256", url.Values{"code_challenge": {s256Challenge(pkceVerifier)}, "code_challenge_method": {"S256"}}, false},
+		{"public without challenge", "public", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loc := pkceAuthorize(t, srv, disc, tc.client, tc.challenge)
+			code, errCode := loc.Query().Get("code"), loc.Query().Get("error")
+			if tc.rejected && (code != "" || errCode != "invalid_request") {
+				t.Fatalf("got code %q and error %q, want invalid_request", code, errCode)
+			}
+			if !tc.rejected && code == "" {
+				t.Fatalf("got error %q: %s", errCode, loc.Query().Get("error_description"))
+			}
+		})
+	}
+}
+
+func TestPKCETokenDowngrades(t *testing.T) {
+	srv, disc := newPKCETest(t)
+	challenge := url.Values{"code_challenge": {s256Challenge(pkceVerifier)}, "code_challenge_method": {"S256"}}
+	for _, tc := range []struct {
+		name      string
+		client    string
+		secret    string
+		challenge url.Values
+		verifier  string
+		ok        bool
+	}{
+		{"challenge dropped at the token endpoint", "s256", "secret", challenge, "", false},
+		{"wrong verifier", "s256", "secret", challenge, strings.Repeat("x", 50), false},
+		{"matching verifier", "s256", "secret", challenge, pkceVerifier, true},
+		{"verifier for a code without challenge", "optional", "secret", nil, pkceVerifier, false},
+		{"no pkce for an optional client", "optional", "secret", nil, "", true},
+		{"public client with verifier", "public", "", challenge, pkceVerifier, true},
+		{"public client without verifier", "public", "", challenge, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := pkceAuthorize(t, srv, disc, tc.client, tc.challenge).Query().Get("code")
+			if code == "" {
+				t.Fatal("no authorization code issued")
+			}
+			form := url.Values{"code": {code}, "redirect_uri": {pkceRedirect}}
+			if tc.verifier != "" {
+				form.Set("code_verifier", tc.verifier)
+			}
+			body := exchangeCode(t, srv, tc.client, tc.secret, form)
+			if tc.ok && body["access_token"] == nil {
+				t.Fatalf("token request failed: %v", body)
+			}
+			if !tc.ok && body["error"] == nil {
+				t.Fatalf("token request succeeded: %v", body)
+			}
+		})
+	}
+}
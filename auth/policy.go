@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/parkour-vienna/distrust/policy"
+	"github.com/rs/zerolog/log"
+)
+
+// PolicyInput builds the policy input for a user with the given DiscourseConnect payload
+func PolicyInput(values url.Values, roles, scopes []string, now time.Time) policy.Input {
+	return policy.Input{
+		Username:  values.Get("username"),
+		Name:      values.Get("name"),
+		Email:     values.Get("email"),
+		Groups:    strings.Split(values.Get("groups"), ","),
+		Roles:     roles,
+		Admin:     values.Get("admin") == "true",
+		Moderator: values.Get("moderator") == "true",
+		Scopes:    scopes,
+		Time:      now,
+	}
+}
+
+// checkPolicy evaluates the policy of the client and logs the decision trace
+func checkPolicy(client *DistrustClient, in policy.Input) error {
+	if client.Policy == nil {
+		return nil
+	}
+	allowed, trace := client.Policy.Evaluate(in)
+	level := log.Debug()
+	if !allowed {
+		level = log.Info()
+	}
+	level.
+		Str("client", client.GetID()).
+		Str("username", in.Username).
+		Str("policy", client.Policy.String()).
+		Strs("trace", trace).
+		Bool("allowed", allowed).
+		Msg("evaluated access policy")
+	if !allowed {
+		return errors.New("access is denied by the policy of this application")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/rs/zerolog/log"
+)
+
+// loginPrompt holds the OpenID Connect parameters of an authorize request which decide whether
+// the user has to log in at discourse. fosite validates them again when the response is built.
+type loginPrompt struct {
+	// none forbids any interaction, login and selectAccount require a discourse login
+	none, login, selectAccount bool
+	// maxAge is the maximum time since the login in seconds, negative if not set
+	maxAge int64
+	// loginHint is the username or email of the user the client expects
+	loginHint string
+	// hintSubject is the subject of the id_token_hint
+	hintSubject string
+}
+
+// parsePrompt reads the prompt, max_age, login_hint and id_token_hint parameters of the request
+func (o *OIDCProvider) parsePrompt(ctx context.Context, ar fosite.AuthorizeRequester, issuer string) (*loginPrompt, error) {
+	form := ar.GetRequestForm()
+	lp := &loginPrompt{maxAge: -1, loginHint: form.Get("login_hint")}
+	prompts := fosite.RemoveEmpty(strings.Split(form.Get("prompt"), " "))
+	for _, p := range prompts {
+		switch p {
+		case "none":
+			lp.none = true
+		case "login":
+			lp.login = true
+		case "select_account":
+			lp.selectAccount = true
+		case "consent":
+		default:
+			return nil, fosite.ErrInvalidRequest.WithHintf("Used unknown value '%s' for prompt parameter.", p)
+		}
+	}
+	if lp.none && len(prompts) > 1 {
+		return nil, fosite.ErrInvalidRequest.WithHint("Parameter 'prompt' was set to 'none', but contains other values as well which is not allowed.")
+	}
+	if v := form.Get("max_age"); v != "" {
+		maxAge, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxAge < 0 {
+			return nil, fosite.ErrInvalidRequest.WithHint("Parameter 'max_age' must be a non-negative number of seconds.")
+		}
+		lp.maxAge = maxAge
+	}
+	if hint := form.Get("id_token_hint"); hint != "" {
+		claims, err := o.decodeIDTokenHint(ctx, hint, issuer)
+		if err != nil {
+			return nil, fosite.ErrInvalidRequest.WithHint("The id_token_hint is invalid.").WithWrap(err).WithDebug(err.Error())
+		}
+		lp.hintSubject, _ = claims["sub"].(string)
+		if lp.hintSubject == "" {
+			return nil, fosite.ErrInvalidRequest.WithHint("The id_token_hint does not have a subject.")
+		}
+	}
+	return lp, nil
+}
+
+// allows reports whether the authorize request can be answered with the sso session
+func (lp *loginPrompt) allows(s *ssoSession) bool {
+	switch {
+	case lp.login, lp.selectAccount:
+		return false
+	case lp.maxAge >= 0 && time.Now().After(time.Unix(s.AuthTime, 0).Add(time.Duration(lp.maxAge)*time.Second)):
+		log.Debug().Int64("max_age", lp.maxAge).Msg("sso session is too old")
+		return false
+	case lp.hintSubject != "" && lp.hintSubject != s.Values.Get("external_id"):
+		log.Debug().Msg("sso session does not match id_token_hint")
+		return false
+	case lp.loginHint != "" && !lp.matchesLoginHint(s):
+		log.Debug().Msg("sso session does not match login_hint")
+		return false
+	}
+	return true
+}
+
+func (lp *loginPrompt) matchesLoginHint(s *ssoSession) bool {
+	return slices.ContainsFunc([]string{s.Values.Get("username"), s.Values.Get("email")}, func(v string) bool {
+		return v != "" && strings.EqualFold(v, lp.loginHint)
+	})
+}
+
+// silent reports whether discourse can be asked to log the user in without interaction. The time of
+// such logins is not known, so requests with max_age are not passed to discourse.
+func (lp *loginPrompt) silent() bool {
+	return lp.none && lp.maxAge < 0
+}
+
+// promptNone reports whether the authorize request forbids any interaction with the user
+func promptNone(ar fosite.AuthorizeRequester) bool {
+	return slices.Contains(strings.Split(ar.GetRequestForm().Get("prompt"), " "), "none")
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+)
+
+// idTokenClaims decodes the claims of the id token in a token response without verifying it
+func idTokenClaims(t *testing.T, body map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	token, _ := body["id_token"].(string)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("no id token in %v", body)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestSilentDiscourseLogin(t *testing.T) {
+	user := url.Values{"external_id": {"42"}, "username": {"alice"}}
+	disc := newDiscourseStub(t, user)
+	o, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "test",
+			Public:        true,
+			RedirectURIs:  []string{"https://rp.example.com/cb"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scopes:        []string{"openid"},
+		}},
+	}, WithSSOSession(time.Hour), WithDiscoursePromptNone(true))
+	browser := newBrowser(t, srv, disc)
+	login := func(query url.Values) (*url.URL, map[string]interface{}) {
+		t.Helper()
+		q := url.Values{
+			"client_id":             {"test"},
+			"response_type":         {"code"},
+			"scope":                 {"openid"},
+			"redirect_uri":          {"https://rp.example.com/cb"},
+			"state":                 {"some-state-value"},
+			"nonce":                 {"some-nonce-value"},
+			"code_challenge":        {pkceVerifier},
+			"code_challenge_method": {"plain"},
+		}
+		for k, v := range query {
+			q[k] = v
+		}
+		loc := authorize(t, browser, srv, q)
+		if loc.Query().Get("code") == "" {
+			return loc, nil
+		}
+		body := exchangeCode(t, srv, "test", "", url.Values{
+			"code":          {loc.Query().Get("code")},
+			"redirect_uri":  {"https://rp.example.com/cb"},
+			"code_verifier": {pkceVerifier},
+		})
+		return loc, idTokenClaims(t, body)
+	}
+	ssoCookieValue := func() string {
+		for _, c := range browser.Jar.Cookies(&url.URL{Scheme: "http", Host: strings.TrimPrefix(srv.URL, "http://"), Path: o.root}) {
+			if c.Name == ssoCookie {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	// without sso session, the time of the discourse login is not known
+	if loc, _ := login(url.Values{"prompt": {"none"}}); loc.Query().Get("error") != "login_required" {
+		t.Fatalf("silent login without sso session: %s", loc)
+	}
+
+	_, first := login(nil)
+	if first == nil {
+		t.Fatal("interactive login failed")
+	}
+	cookie := ssoCookieValue()
+	time.Sleep(1100 * time.Millisecond)
+
+	// the login hint does not match the sso session, so discourse is asked
+	_, silent := login(url.Values{"prompt": {"none"}, "login_hint": {"alice@example.com"}})
+	if silent == nil {
+		t.Fatal("silent login failed")
+	}
+	if silent["auth_time"] != first["auth_time"] || silent["sid"] != first["sid"] {
+		t.Errorf("silent login has auth_time %v and sid %v, want %v and %v", silent["auth_time"], silent["sid"], first["auth_time"], first["sid"])
+	}
+	if ssoCookieValue() != cookie {
+		t.Error("silent login replaced the sso session")
+	}
+
+	// discourse logged in another user than the one of the sso session
+	user.Set("external_id", "7")
+	if loc, _ := login(url.Values{"prompt": {"none"}, "login_hint": {"bob"}}); loc.Query().Get("error") != "login_required" {
+		t.Fatalf("silent login of another user: %s", loc)
+	}
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/rs/zerolog/log"
+)
+
+// proxyLogout is the path which ends the session of the proxy
+const proxyLogout = "/_distrust/logout"
+
+// ProxyRoute restricts access to Path and all paths below it
+type ProxyRoute struct {
+	Path string
+	GroupRules
+}
+
+// Proxy is an authenticating reverse proxy. It requires users to log in through discourse
+// and passes their identity to the upstream service.
+type Proxy struct {
+	discourse discourse.SSOConfig
+	routes    []ProxyRoute
+	sessions  *sessionCookies
+	upstream  *httputil.ReverseProxy
+}
+
+// NewProxy creates a proxy in front of upstream. Requests are checked against the route with the
+// longest matching path, requests without matching route only require a login.
+func NewProxy(disc discourse.SSOConfig, secret []byte, upstream *url.URL, routes []ProxyRoute, lifetime time.Duration) *Proxy {
+	sorted := append([]ProxyRoute{}, routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Path) > len(sorted[j].Path)
+	})
+	return &Proxy{
+		discourse: disc,
+		routes:    sorted,
+		sessions:  newSessionCookies(secret, "distrust_proxy", lifetime),
+		upstream:  httputil.NewSingleHostReverseProxy(upstream),
+	}
+}
+
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// routes are checked and requests forwarded with the cleaned path, so dot segments
+	// and repeated slashes can not reach paths of stricter routes
+	if clean := cleanPath(req.URL.Path); clean != req.URL.Path {
+		req.URL.Path, req.URL.RawPath = clean, ""
+	}
+	secure := isSecure(req)
+	switch req.URL.Path {
+	case forwardAuthCallback:
+		p.callback(rw, req, secure)
+		return
+	case proxyLogout:
+		// links and images of other sites can not log the user out
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.sessions.clearSession(rw, secure)
+		http.Redirect(rw, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	session, err := p.sessions.getSession(req)
+	if err != nil {
+		p.login(rw, req, secure)
+		return
+	}
+	if err := validateAccess(p.route(req.URL.Path), session.Groups, nil); err != nil {
+		log.Info().Err(err).Str("username", session.Username).Str("path", req.URL.Path).Msg("proxy access denied")
+		http.Error(rw, "You are not allowed to access this page: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// never trust identity headers sent by the client
+	req.Header.Set("X-Forwarded-User", session.Username)
+	req.Header.Set("X-Forwarded-Email", session.Email)
+	req.Header.Set("X-Forwarded-Groups", strings.Join(session.Groups, ","))
+	p.upstream.ServeHTTP(rw, req)
+}
+
+// route returns the rules of the longest route containing the path
+func (p *Proxy) route(path string) GroupRules {
+	for _, r := range p.routes {
+		if path == r.Path || strings.HasPrefix(path, strings.TrimSuffix(r.Path, "/")+"/") {
+			return r.GroupRules
+		}
+	}
+	return GroupRules{}
+}
+
+// cleanPath resolves dot segments and repeated slashes, keeping a trailing slash
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func (p *Proxy) login(rw http.ResponseWriter, req *http.Request, secure bool) {
+	nonce := rand.Int()
+	// only the path is stored, so the login can not redirect to other hosts
+	if err := p.sessions.setState(rw, secure, nonce, req.URL.RequestURI()); err != nil {
+		log.Error().Err(err).Msg("storing login state")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	callback := scheme + "://" + req.Host + forwardAuthCallback
+	http.Redirect(rw, req, discourse.GenerateURL(p.discourse.Server, callback, p.discourse.Secret, nonce), http.StatusFound)
+}
+
+func (p *Proxy) callback(rw http.ResponseWriter, req *http.Request, secure bool) {
+	state, err := p.sessions.getState(rw, req, secure)
+	if err != nil {
+		log.Warn().Err(err).Msg("restoring login state")
+		http.Error(rw, "invalid session, please try again", http.StatusBadRequest)
+		return
+	}
+	q := req.URL.Query()
+	values, err := discourse.ValidateResponse(q.Get("sso"), q.Get("sig"), p.discourse.Secret, state.Nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("validating discourse response")
+		http.Error(rw, "invalid discourse response", http.StatusBadRequest)
+		return
+	}
+	session, err := p.sessions.setSession(rw, secure, values)
+	if err != nil {
+		log.Error().Err(err).Msg("storing session")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("username", session.Username).Msg("user logged in through proxy")
+	http.Redirect(rw, req, state.Redirect, http.StatusFound)
+}
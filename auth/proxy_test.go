@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkour-vienna/distrust/discourse"
+)
+
+func newTestProxy(t *testing.T, upstream http.Handler) *Proxy {
+	t.Helper()
+	srv := httptest.NewServer(upstream)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return NewProxy(discourse.SSOConfig{Server: "https://discourse.example.com", Secret: testDiscourseSecret}, []byte("some-exactly-32-byte-long-secret"), u, []ProxyRoute{
+		{Path: "/admin", GroupRules: GroupRules{AllowGroups: []string{"admins"}}},
+		{Path: "/admin/public/", GroupRules: GroupRules{AllowGroups: []string{"team"}}},
+		{Path: "/private/", GroupRules: GroupRules{DenyGroups: []string{"team"}}},
+	}, time.Hour)
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/", "/"},
+		{"", "/"},
+		{"admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"/public/../admin", "/admin"},
+		{"/public/../admin/", "/admin/"},
+		{"/../../admin", "/admin"},
+		{"/./admin/./x", "/admin/x"},
+		{"//admin", "/admin"},
+		{"/public//..//admin//", "/admin/"},
+		// percent encoded dots are decoded into the path before it is cleaned
+		{"/public/%2e%2e/admin", "/admin"},
+		{"/public/%2E%2E/%2e%2E/admin/", "/admin/"},
+		{"/public%2f..%2fadmin", "/admin"},
+	} {
+		path, err := url.PathUnescape(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cleanPath(path); got != tc.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestProxyRoute(t *testing.T) {
+	p := newTestProxy(t, http.NotFoundHandler())
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/admin", "admins"},
+		{"/admin/", "admins"},
+		{"/admin/users", "admins"},
+		{"/admin/public", "admins"},
+		{"/admin/public/", "team"},
+		{"/admin/public/page", "team"},
+		// a route only matches whole path segments
+		{"/administrator", ""},
+		{"/admin-old/", ""},
+		// requests without route only require a login
+		{"/", ""},
+		{"/other/admin", ""},
+	} {
+		if got := strings.Join(p.route(tc.path).AllowGroups, ","); got != tc.want {
+			t.Errorf("route(%q) allows %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	if rules := p.route("/private/x"); len(rules.DenyGroups) != 1 {
+		t.Errorf("route with trailing slash was not matched: %v", rules)
+	}
+}
+
+// proxyLogin logs alice in through the proxy and returns the session cookie
+func proxyLogin(t *testing.T, p *Proxy) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+	state := responseCookie(rec.Result(), "distrust_proxy_state")
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || state == nil || loc.Host != "discourse.example.com" {
+		t.Fatalf("login was not started: %d %s", rec.Code, loc)
+	}
+	callback, err := discourseLogin(loc.Query().Get("sso"), url.Values{"external_id": {"42"}, "username": {"alice"}, "groups": {"team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	req.AddCookie(state)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/page" {
+		t.Fatalf("callback did not return to the page: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	session := responseCookie(rec.Result(), "distrust_proxy")
+	if session == nil {
+		t.Fatal("no session stored")
+	}
+	return session
+}
+
+func TestProxyAccess(t *testing.T) {
+	var upstreamPath, upstreamUser string
+	p := newTestProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamPath, upstreamUser = req.URL.Path, req.Header.Get("X-Forwarded-User")
+	}))
+	session := proxyLogin(t, p)
+
+	for _, tc := range []struct {
+		target string
+		status int
+		path   string
+	}{
+		{"/page", http.StatusOK, "/page"},
+		{"/admin", http.StatusForbidden, ""},
+		{"/admin/users", http.StatusForbidden, ""},
+		{"/administrator", http.StatusOK, "/administrator"},
+		{"/admin/public/page", http.StatusOK, "/admin/public/page"},
+		{"/private/page", http.StatusForbidden, ""},
+		// paths are cleaned before the route is looked up and the request is forwarded
+		{"/public/../admin/users", http.StatusForbidden, ""},
+		{"/public/%2e%2e/admin/users", http.StatusForbidden, ""},
+		{"/public/%2E%2E/%2E%2E/admin", http.StatusForbidden, ""},
+		{"/public%2f..%2fadmin", http.StatusForbidden, ""},
+		{"//admin/users", http.StatusForbidden, ""},
+		{"/admin/public/../users", http.StatusForbidden, ""},
+		{"/admin/public//page", http.StatusOK, "/admin/public/page"},
+		{"/./other/../page", http.StatusOK, "/page"},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			upstreamPath, upstreamUser = "", ""
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			req.Header.Set("X-Forwarded-User", "admin")
+			req.AddCookie(session)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.status)
+			}
+			if upstreamPath != tc.path {
+				t.Errorf("upstream got path %q, want %q", upstreamPath, tc.path)
+			}
+			if tc.path != "" && upstreamUser != "alice" {
+				t.Errorf("upstream got user %q", upstreamUser)
+			}
+		})
+	}
+}
+
+func TestProxyLogout(t *testing.T) {
+	p := newTestProxy(t, http.NotFoundHandler())
+	session := proxyLogin(t, p)
+
+	req := httptest.NewRequest(http.MethodGet, proxyLogout, nil)
+	req.AddCookie(session)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("logout with GET: got %d with cookies %v", rec.Code, rec.Result().Cookies())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, proxyLogout, nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("logout with POST: got %d", rec.Code)
+	}
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		cleared = cleared || (c.Name == "distrust_proxy" && c.MaxAge < 0)
+	}
+	if !cleared {
+		t.Error("session cookie was not cleared")
+	}
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// ClientMetadata is the client metadata of OAuth 2.0 Dynamic Client Registration (RFC 7591)
+type ClientMetadata struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	Scope                   string   `json:"scope"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	PostLogoutRedirectURIs  []string `json:"post_logout_redirect_uris,omitempty"`
+	BackchannelLogoutURI    string   `json:"backchannel_logout_uri,omitempty"`
+}
+
+type clientRegistrationResponse struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+	ClientMetadata
+}
+
+// registrationOptions control who may register clients
+type registrationOptions struct {
+	open                bool
+	initialAccessTokens []string
+}
+
+func (r registrationOptions) enabled() bool {
+	return r.open || len(r.initialAccessTokens) != 0
+}
+
+type registrationError struct {
+	code        string
+	description string
+}
+
+func (e *registrationError) Error() string {
+	return e.code + ": " + e.description
+}
+
+var (
+	registrableGrantTypes = []string{"authorization_code", "refresh_token", "implicit"}
+	registrableScopes     = []string{"openid", "profile", "email", "groups", "roles"}
+)
+
+// registerEndpoint implements OAuth 2.0 Dynamic Client Registration (RFC 7591)
+func (o *OIDCProvider) registerEndpoint(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !o.mayRegister(req) {
+		writeRegistrationError(rw, http.StatusUnauthorized, &registrationError{"invalid_token", "a valid initial access token is required"})
+		return
+	}
+	var m ClientMetadata
+	if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+		writeRegistrationError(rw, http.StatusBadRequest, &registrationError{"invalid_client_metadata", "malformed client metadata"})
+		return
+	}
+	if err := m.validate(ctx); err != nil {
+		writeRegistrationError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	rc, secret, token, err := o.createClient(ctx, storedClient{Metadata: m})
+	var re *registrationError
+	if errors.As(err, &re) {
+		writeRegistrationError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("storing registered client")
+		writeRegistrationError(rw, http.StatusInternalServerError, &registrationError{"server_error", "storing client"})
+		return
+	}
+	log.Info().Str("client", rc.ID).Str("name", m.ClientName).Strs("redirectURIs", m.RedirectURIs).Msg("registered client")
+
+	resp := o.registrationResponse(req, *rc, m)
+	resp.ClientSecret = secret
+	resp.RegistrationAccessToken = token
+	writeRegistrationResponse(rw, http.StatusCreated, resp)
+}
+
+// registeredClientEndpoint implements OAuth 2.0 Dynamic Client Registration Management (RFC 7592)
+func (o *OIDCProvider) registeredClientEndpoint(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	rc, err := o.store.GetRegisteredClient(ctx, chi.URLParam(req, "id"))
+	if err != nil || !validToken(bearerToken(req), rc.RegistrationTokenHash) {
+		writeRegistrationError(rw, http.StatusUnauthorized, &registrationError{"invalid_token", "invalid registration access token"})
+		return
+	}
+	var sc storedClient
+	if err := json.Unmarshal([]byte(rc.Data), &sc); err != nil {
+		writeRegistrationError(rw, http.StatusInternalServerError, &registrationError{"server_error", "decoding client"})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeRegistrationResponse(rw, http.StatusOK, o.registrationResponse(req, *rc, sc.Metadata))
+	case http.MethodPut:
+		var update struct {
+			ClientID string `json:"client_id"`
+			ClientMetadata
+		}
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			writeRegistrationError(rw, http.StatusBadRequest, &registrationError{"invalid_client_metadata", "malformed client metadata"})
+			return
+		}
+		if update.ClientID != "" && update.ClientID != rc.ID {
+			writeRegistrationError(rw, http.StatusBadRequest, &registrationError{"invalid_client_metadata", "client_id does not match"})
+			return
+		}
+		if err := update.ClientMetadata.validate(ctx); err != nil {
+			writeRegistrationError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if (update.TokenEndpointAuthMethod == "none") != (sc.Metadata.TokenEndpointAuthMethod == "none") {
+			writeRegistrationError(rw, http.StatusBadRequest, &registrationError{"invalid_client_metadata", "a client can not switch between public and confidential"})
+			return
+		}
+		sc.Metadata = update.ClientMetadata
+		err := o.updateClient(ctx, rc, sc)
+		var re *registrationError
+		if errors.As(err, &re) {
+			writeRegistrationError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("client", rc.ID).Msg("updating registered client")
+			writeRegistrationError(rw, http.StatusInternalServerError, &registrationError{"server_error", "storing client"})
+			return
+		}
+		log.Info().Str("client", rc.ID).Msg("updated registered client")
+		writeRegistrationResponse(rw, http.StatusOK, o.registrationResponse(req, *rc, sc.Metadata))
+	case http.MethodDelete:
+		if err := o.deleteRegisteredClient(ctx, rc.ID); err != nil {
+			log.Error().Err(err).Str("client", rc.ID).Msg("deleting registered client")
+			writeRegistrationError(rw, http.StatusInternalServerError, &registrationError{"server_error", "deleting client"})
+			return
+		}
+		log.Info().Str("client", rc.ID).Msg("deleted registered client")
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// createClient stores a new client with a generated id, secret and registration access token.
+// Clients which are not valid are rejected with a registrationError.
+func (o *OIDCProvider) createClient(ctx context.Context, sc storedClient) (rc *storage.RegisteredClient, secret, token string, err error) {
+	var secretHash string
+	if sc.Metadata.TokenEndpointAuthMethod != "none" {
+		secret = randomToken()
+		hash, err := o.config.GetSecretsHasher(ctx).Hash(ctx, []byte(secret))
+		if err != nil {
+			return nil, "", "", fmt.Errorf("hashing client secret: %w", err)
+		}
+		secretHash = string(hash)
+	}
+	data, err := encodeClient(sc)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("encoding client: %w", err)
+	}
+	token = randomToken()
+	now := time.Now()
+	rc = &storage.RegisteredClient{
+		ID:                    uuid.New().String(),
+		SecretHash:            secretHash,
+		Data:                  data,
+		RegistrationTokenHash: hashToken(token),
+		CreatedAt:             now,
+		UpdatedAt:             now,
+	}
+	if err := validateRegisteredClient(rc); err != nil {
+		return nil, "", "", err
+	}
+	if err := o.store.CreateRegisteredClient(ctx, *rc); err != nil {
+		return nil, "", "", err
+	}
+	return rc, secret, token, nil
+}
+
+// updateClient stores the changed client data. Clients which are not valid are rejected with a registrationError.
+func (o *OIDCProvider) updateClient(ctx context.Context, rc *storage.RegisteredClient, sc storedClient) error {
+	data, err := encodeClient(sc)
+	if err != nil {
+		return fmt.Errorf("encoding client: %w", err)
+	}
+	updated := *rc
+	updated.Data = data
+	updated.UpdatedAt = time.Now()
+	if err := validateRegisteredClient(&updated); err != nil {
+		return err
+	}
+	if err := o.store.UpdateRegisteredClient(ctx, updated); err != nil {
+		return err
+	}
+	*rc = updated
+	return nil
+}
+
+// validateRegisteredClient applies the checks of configured clients to the client fosite will load for rc
+func validateRegisteredClient(rc *storage.RegisteredClient) error {
+	client, err := decodeClient(rc)
+	if err == nil {
+		err = client.(*DistrustClient).Validate()
+	}
+	if err != nil {
+		return &registrationError{"invalid_client_metadata", err.Error()}
+	}
+	return nil
+}
+
+// deleteRegisteredClient removes a registered client and revokes all its tokens
+func (o *OIDCProvider) deleteRegisteredClient(ctx context.Context, id string) error {
+	if err := o.store.RevokeClient(ctx, id); err != nil {
+		return err
+	}
+	return o.store.DeleteRegisteredClient(ctx, id)
+}
+
+func (o *OIDCProvider) mayRegister(req *http.Request) bool {
+	if o.registration.open {
+		return true
+	}
+	token := bearerToken(req)
+	for _, t := range o.registration.initialAccessTokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OIDCProvider) registrationResponse(req *http.Request, rc storage.RegisteredClient, m ClientMetadata) *clientRegistrationResponse {
+	return &clientRegistrationResponse{
+		ClientID:              rc.ID,
+		ClientIDIssuedAt:      rc.CreatedAt.Unix(),
+		RegistrationClientURI: o.getAuthRoot(req) + "/register/" + rc.ID,
+		ClientMetadata:        m,
+	}
+}
+
+// validate checks the metadata and fills in defaults for missing values
+func (m *ClientMetadata) validate(ctx context.Context) error {
+	if len(m.RedirectURIs) == 0 {
+		return &registrationError{"invalid_redirect_uri", "at least one redirect uri is required"}
+	}
+	for _, uri := range m.RedirectURIs {
+		if err := validateClientURI(ctx, uri); err != nil {
+			return &registrationError{"invalid_redirect_uri", err.Error()}
+		}
+	}
+	for _, uri := range m.PostLogoutRedirectURIs {
+		if err := validateClientURI(ctx, uri); err != nil {
+			return &registrationError{"invalid_client_metadata", "post_logout_redirect_uris: " + err.Error()}
+		}
+	}
+	if m.BackchannelLogoutURI != "" {
+		if err := validateClientURI(ctx, m.BackchannelLogoutURI); err != nil {
+			return &registrationError{"invalid_client_metadata", "backchannel_logout_uri: " + err.Error()}
+		}
+	}
+
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{"authorization_code"}
+	}
+	if len(m.ResponseTypes) == 0 {
+		m.ResponseTypes = []string{"code"}
+	}
+	if m.Scope == "" {
+		m.Scope = strings.Join(registrableScopes, " ")
+	}
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+
+	checks := []error{
+		subset("grant_types", m.GrantTypes, registrableGrantTypes),
+		subset("response_types", m.ResponseTypes, supportedResponseTypes),
+		subset("scope", strings.Fields(m.Scope), registrableScopes),
+		subset("token_endpoint_auth_method", []string{m.TokenEndpointAuthMethod}, supportedAuthMethods),
+		checkResponseTypes(m.GrantTypes, m.ResponseTypes),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return &registrationError{"invalid_client_metadata", err.Error()}
+		}
+	}
+	return nil
+}
+
+func validateClientURI(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !fosite.IsValidRedirectURI(u) {
+		return fmt.Errorf("%q is not a valid uri", raw)
+	}
+	if !fosite.IsRedirectURISecure(ctx, u) {
+		return fmt.Errorf("%q must use https", raw)
+	}
+	return nil
+}
+
+func subset(field string, values, allowed []string) error {
+	for _, v := range values {
+		if !slices.Contains(allowed, v) {
+			return fmt.Errorf("%s %q is not supported", field, v)
+		}
+	}
+	return nil
+}
+
+func writeRegistrationResponse(rw http.ResponseWriter, status int, resp *clientRegistrationResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+func writeRegistrationError(rw http.ResponseWriter, status int, err error) {
+	var re *registrationError
+	if !errors.As(err, &re) {
+		re = &registrationError{"invalid_client_metadata", err.Error()}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(map[string]string{"error": re.code, "error_description": re.description})
+}
+
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func validToken(token, hash string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1
+}
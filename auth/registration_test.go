@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/metrics"
+)
+
+func registrationRequest(t *testing.T, method, url, token string, metadata map[string]interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	raw, _ := json.Marshal(metadata)
+	req, _ := http.NewRequest(method, url, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestRegistrationValidatesClients(t *testing.T) {
+	o, srv := newTestProvider(t, "https://discourse.example.com", map[string]fosite.Client{}, WithRegistration(true, nil))
+	register := srv.URL + "/oauth2/register"
+
+	// the refresh token grant is useless without authorization codes
+	status, body := registrationRequest(t, http.MethodPost, register, "", map[string]interface{}{
+		"redirect_uris":  []string{"https://rp.example.com/cb"},
+		"grant_types":    []string{"implicit", "refresh_token"},
+		"response_types": []string{"id_token token"},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_client_metadata" {
+		t.Fatalf("invalid client registered: %d %v", status, body)
+	}
+
+	status, body = registrationRequest(t, http.MethodPost, register, "", map[string]interface{}{
+		"redirect_uris":  []string{"https://rp.example.com/cb"},
+		"grant_types":    []string{"implicit"},
+		"response_types": []string{"id_token token"},
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("valid client rejected: %d %v", status, body)
+	}
+	clientURI, _ := body["registration_client_uri"].(string)
+	token, _ := body["registration_access_token"].(string)
+	id, _ := body["client_id"].(string)
+
+	status, body = registrationRequest(t, http.MethodPut, clientURI, token, map[string]interface{}{
+		"client_id":      id,
+		"redirect_uris":  []string{"https://rp.example.com/cb"},
+		"grant_types":    []string{"implicit", "refresh_token"},
+		"response_types": []string{"id_token token"},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_client_metadata" {
+		t.Fatalf("client updated to an invalid one: %d %v", status, body)
+	}
+	client, err := o.store.GetClient(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetGrantTypes().Has("refresh_token") {
+		t.Error("invalid update was stored")
+	}
+}
+
+func TestRegisteredClientMetrics(t *testing.T) {
+	disc := newDiscourseStub(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+	_, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{}, WithRegistration(true, nil))
+	status, body := registrationRequest(t, http.MethodPost, srv.URL+"/oauth2/register", "", map[string]interface{}{
+		"redirect_uris":  []string{"https://rp.example.com/cb"},
+		"grant_types":    []string{"implicit"},
+		"response_types": []string{"id_token token"},
+		"scope":          "openid",
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("registration failed: %d %v", status, body)
+	}
+	id, _ := body["client_id"].(string)
+
+	loc := authorize(t, newBrowser(t, srv, disc), srv, url.Values{
+		"client_id":     {id},
+		"response_type": {"id_token token"},
+		"scope":         {"openid"},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"state":         {"some-state-value"},
+		"nonce":         {"some-nonce-value"},
+	})
+	if loc.Fragment == "" || strings.Contains(loc.Fragment, "error") {
+		t.Fatalf("login failed: %s", loc)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `distrust_authorize_requests_total{client="registered",result="ok"}`) {
+		t.Error("authorize request of the registered client was not counted as registered")
+	}
+	if strings.Contains(rec.Body.String(), id) {
+		t.Error("id of the registered client is used as label")
+	}
+}
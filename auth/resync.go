@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/tracing"
+	"github.com/rs/zerolog/log"
+)
+
+// resyncUser updates the session of a refresh token grant with the current user data from the
+// discourse admin api. Refreshing is refused for suspended, deactivated and deleted users and
+// for users who lost access to the client.
+func (o *OIDCProvider) resyncUser(ctx context.Context, ar fosite.AccessRequester) error {
+	if !o.discourseResync || o.discourseAPI == nil || !ar.GetGrantTypes().ExactOne("refresh_token") {
+		return nil
+	}
+	session, ok := ar.GetSession().(*openid.DefaultSession)
+	if !ok || session.Claims == nil {
+		return nil
+	}
+	ctx, span := tracing.Start(ctx, "resync")
+	defer span.End()
+
+	sid, _ := session.Claims.Extra["sid"].(string)
+	values, err := o.currentUser(ctx, session.Subject, o.loginPayload(ctx, session.Subject, sid, ar.GetClient().GetID()))
+	if err != nil {
+		tracing.Fail(span, err)
+		return err
+	}
+	if values.Get("email") == "" {
+		// logins recorded without payload
+		email, _ := session.Claims.Extra["email"].(string)
+		values.Set("email", email)
+	}
+	roles := o.roleMappings(ar.GetClient()).Roles(strings.Split(values.Get("groups"), ","), values)
+	if err := checkAccess(ar.GetClient(), values, roles, ar.GetGrantedScopes()); err != nil {
+		log.Info().Err(err).Str("subject", session.Subject).Str("client", ar.GetClient().GetID()).Msg("refusing refresh of user without access")
+		err = fosite.ErrInvalidGrant.WithHint("The user is not allowed to access this client anymore.").WithDebug(err.Error())
+		tracing.Fail(span, err)
+		return err
+	}
+
+	fresh := o.userSession(session.Claims.Issuer, ar, values, roles)
+	fresh.Claims.Extra["sid"] = session.Claims.Extra["sid"]
+	session.Username = fresh.Username
+	session.Claims.Extra = fresh.Claims.Extra
+	return nil
+}
+
+// currentUser loads the user from the discourse admin api and returns payload with the fields
+// replaced by their current values. Suspended, deactivated and deleted users are refused.
+func (o *OIDCProvider) currentUser(ctx context.Context, subject string, payload url.Values) (url.Values, error) {
+	user, err := o.discourseAPI.GetUser(ctx, subject)
+	switch {
+	case errors.Is(err, discourse.ErrNotFound):
+		return nil, fosite.ErrInvalidGrant.WithHint("The user does not exist anymore.")
+	case err != nil:
+		log.Error().Err(err).Str("subject", subject).Msg("loading user from discourse")
+		return nil, fosite.ErrServerError.WithHint("The user could not be loaded from discourse.").WithWrap(err)
+	case !user.Active:
+		return nil, fosite.ErrInvalidGrant.WithHint("The user is deactivated.")
+	case user.Suspended(time.Now()):
+		return nil, fosite.ErrInvalidGrant.WithHint("The user is suspended.")
+	}
+	values := make(url.Values, len(payload))
+	for k, v := range payload {
+		values[k] = v
+	}
+	current := user.Values(o.discourseServer)
+	if current.Get("email") == "" {
+		// the admin api only includes emails for some api keys
+		current.Del("email")
+	}
+	for k, v := range current {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// loginPayload returns the discourse payload recorded for the login of the session at the client, so
+// fields which the admin api does not return are kept
+func (o *OIDCProvider) loginPayload(ctx context.Context, subject, sid, clientID string) url.Values {
+	logins, err := o.store.ListLogins(ctx, subject)
+	if err != nil {
+		log.Warn().Err(err).Str("subject", subject).Msg("loading login payload")
+		return url.Values{}
+	}
+	for _, login := range logins {
+		if login.SessionID == sid && login.ClientID == clientID && login.Payload != nil {
+			return login.Payload
+		}
+	}
+	return url.Values{}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/discourse"
+)
+
+func TestResyncKeepsPayloadFields(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/admin/users/42.json" || req.Header.Get("Api-Key") != "key" {
+			http.NotFound(rw, req)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"id":       42,
+			"username": "alice",
+			"name":     "Alice Renamed",
+			"active":   true,
+			"groups":   []map[string]string{{"name": "admins"}},
+		})
+	}))
+	t.Cleanup(api.Close)
+	disc := newDiscourseStub(t, url.Values{
+		"external_id": {"42"},
+		"username":    {"alice"},
+		"name":        {"Alice"},
+		"email":       {"alice@example.com"},
+		"groups":      {"team"},
+		"locale":      {"de"},
+	})
+	_, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{
+			DefaultClient: fosite.DefaultClient{
+				ID:            "test",
+				Public:        true,
+				RedirectURIs:  []string{"https://rp.example.com/cb"},
+				ResponseTypes: []string{"code"},
+				GrantTypes:    []string{"authorization_code", "refresh_token"},
+				Scopes:        []string{"openid", "offline_access", "profile", "email", "groups"},
+			},
+			Claims: ClaimMappings{"locale": {Field: "locale"}},
+		},
+	}, WithDiscourseAPI(discourse.NewAPIClient(api.URL, "key", "system")), WithDiscourseResync(true))
+
+	loc := authorize(t, newBrowser(t, srv, disc), srv, url.Values{
+		"client_id":             {"test"},
+		"response_type":         {"code"},
+		"scope":                 {"openid offline_access profile email groups"},
+		"redirect_uri":          {"https://rp.example.com/cb"},
+		"state":                 {"some-state-value"},
+		"nonce":                 {"some-nonce-value"},
+		"code_challenge":        {pkceVerifier},
+		"code_challenge_method": {"plain"},
+	})
+	body := exchangeCode(t, srv, "test", "", url.Values{
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"code_verifier": {pkceVerifier},
+	})
+	refreshToken, _ := body["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatalf("no refresh token issued: %v", body)
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "client_id": {"test"}}
+	resp, err := http.Post(srv.URL+"/oauth2/token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body = map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	claims := idTokenClaims(t, body)
+	if claims["name"] != "Alice Renamed" {
+		t.Errorf("name %v was not synced", claims["name"])
+	}
+	if groups, _ := json.Marshal(claims["groups"]); string(groups) != `["admins"]` {
+		t.Errorf("groups %s were not synced", groups)
+	}
+	if claims["locale"] != "de" {
+		t.Errorf("locale %v of the login was not kept", claims["locale"])
+	}
+	if claims["email"] != "alice@example.com" {
+		t.Errorf("email %v of the login was not kept", claims["email"])
+	}
+}
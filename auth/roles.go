@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"net/url"
+	"slices"
+	"sort"
+
+	"github.com/ory/fosite"
+)
+
+// RoleRule grants a role to members of any of the groups and, if enabled,
+// to discourse admins or moderators
+type RoleRule struct {
+	Groups    []string
+	Admin     bool
+	Moderator bool
+}
+
+// RoleMappings maps role names to the rule granting them
+type RoleMappings map[string]RoleRule
+
+// merge returns the roles of m overridden by the roles of client
+func (m RoleMappings) merge(client RoleMappings) RoleMappings {
+	if len(client) == 0 {
+		return m
+	}
+	merged := make(RoleMappings, len(m)+len(client))
+	for name, r := range m {
+		merged[name] = r
+	}
+	for name, r := range client {
+		merged[name] = r
+	}
+	return merged
+}
+
+// Roles returns the sorted roles of a user with the given groups and DiscourseConnect payload
+func (m RoleMappings) Roles(groups []string, values url.Values) []string {
+	roles := []string{}
+	for name, r := range m {
+		granted := (r.Admin && values.Get("admin") == "true") || (r.Moderator && values.Get("moderator") == "true")
+		for _, g := range r.Groups {
+			granted = granted || slices.Contains(groups, g)
+		}
+		if granted {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// roleMappings returns the global roles merged with the roles of the client
+func (o *OIDCProvider) roleMappings(client fosite.Client) RoleMappings {
+	if dc, ok := client.(*DistrustClient); ok {
+		return o.roles.merge(dc.Roles)
+	}
+	return o.roles
+}
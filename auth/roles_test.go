@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/ory/fosite"
+)
+
+func TestRoles(t *testing.T) {
+	mappings := RoleMappings{
+		"staff":   {Admin: true, Moderator: true},
+		"admin":   {Admin: true},
+		"trainer": {Groups: []string{"trainers", "coaches"}},
+		"member":  {Groups: []string{"team", "trainers"}},
+		"nobody":  {},
+	}
+	for _, tc := range []struct {
+		name   string
+		groups []string
+		values url.Values
+		want   []string
+	}{
+		{"no groups", nil, url.Values{}, []string{}},
+		{"unmapped group", []string{"guests"}, url.Values{}, []string{}},
+		{"group", []string{"coaches"}, url.Values{}, []string{"trainer"}},
+		// a role is listed once, even if several of its groups match
+		{"several groups of a role", []string{"trainers", "coaches", "team"}, url.Values{}, []string{"member", "trainer"}},
+		{"admin", nil, url.Values{"admin": {"true"}}, []string{"admin", "staff"}},
+		{"moderator", nil, url.Values{"moderator": {"true"}}, []string{"staff"}},
+		{"admin and moderator", nil, url.Values{"admin": {"true"}, "moderator": {"true"}}, []string{"admin", "staff"}},
+		{"flags are not set", nil, url.Values{"admin": {"false"}, "moderator": {"1"}}, []string{}},
+		{"groups and flags", []string{"team"}, url.Values{"moderator": {"true"}}, []string{"member", "staff"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mappings.Roles(tc.groups, tc.values); !slices.Equal(got, tc.want) {
+				t.Errorf("got roles %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientRoles(t *testing.T) {
+	global := RoleMappings{
+		"staff":   {Admin: true},
+		"trainer": {Groups: []string{"trainers"}},
+	}
+	o, _ := newTestProvider(t, "https://discourse.example.com", map[string]fosite.Client{}, WithRoles(global))
+	client := &DistrustClient{Roles: RoleMappings{
+		// overrides the global role
+		"trainer": {Groups: []string{"coaches"}},
+		"editor":  {Groups: []string{"team"}},
+	}}
+	groups := []string{"trainers", "coaches", "team"}
+	values := url.Values{"admin": {"true"}}
+
+	if got := o.roleMappings(client).Roles(groups, values); !slices.Equal(got, []string{"editor", "staff", "trainer"}) {
+		t.Errorf("client got roles %v", got)
+	}
+	if got := o.roleMappings(client).Roles([]string{"trainers"}, url.Values{}); len(got) != 0 {
+		t.Errorf("overridden global role was granted: %v", got)
+	}
+	if got := o.roleMappings(&DistrustClient{}).Roles(groups, values); !slices.Equal(got, []string{"staff", "trainer"}) {
+		t.Errorf("client without roles got %v", got)
+	}
+	if got := o.roleMappings(&fosite.DefaultClient{}).Roles(groups, values); !slices.Equal(got, []string{"staff", "trainer"}) {
+		t.Errorf("plain client got %v", got)
+	}
+	if len(global) != 2 || !slices.Equal(global["trainer"].Groups, []string{"trainers"}) {
+		t.Error("global roles were modified by the merge")
+	}
+}
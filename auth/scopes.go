@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+)
+
+// scopeClaims lists the claims released for each scope. Claims which are neither listed
+// nor mapped, like sid, are always released.
+var scopeClaims = map[string][]string{
+	"profile": {"name", "preferred_username", "picture"},
+	"email":   {"email", "email_verified"},
+	"groups":  {"groups"},
+	"roles":   {"roles"},
+}
+
+// supportedScopes are the scopes advertised in the discovery document
+var supportedScopes = []string{"openid", "profile", "email", "groups", "roles"}
+
+// releaseClaims removes all claims whose scope has not been granted
+func releaseClaims(claims map[string]interface{}, granted fosite.Arguments, mappings ClaimMappings) map[string]interface{} {
+	released := make(map[string]interface{}, len(claims))
+	for name, v := range claims {
+		if scope := claimScope(name, mappings); scope == "" || granted.Has(scope) {
+			released[name] = v
+		}
+	}
+	return released
+}
+
+// supportedClaims returns the claims advertised in the discovery document
+func supportedClaims() []string {
+	claims := []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "sid"}
+	for _, scope := range supportedScopes {
+		claims = append(claims, scopeClaims[scope]...)
+	}
+	return claims
+}
+
+// introspectionSession exposes the released claims of a session in introspection responses
+type introspectionSession struct {
+	*openid.DefaultSession
+	granted  fosite.Arguments
+	mappings ClaimMappings
+}
+
+func (s *introspectionSession) GetExtraClaims() map[string]interface{} {
+	if s.Claims == nil {
+		return nil
+	}
+	return releaseClaims(s.Claims.Extra, s.granted, s.mappings)
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+)
+
+func TestReleaseClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"sid":                "session",
+		"name":               "Alice",
+		"preferred_username": "alice",
+		"picture":            "https://discourse.example.com/alice.png",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"groups":             []string{"team"},
+		"roles":              []string{"editor"},
+		"nickname":           "ali",
+		"tenant":             "parkour-vienna",
+	}
+	mappings := ClaimMappings{
+		"nickname": {Field: "username"},
+		"tenant":   {Value: "parkour-vienna", Scope: "groups"},
+	}
+	for _, tc := range []struct {
+		granted fosite.Arguments
+		want    []string
+	}{
+		{nil, []string{"sid"}},
+		{fosite.Arguments{"openid"}, []string{"sid"}},
+		{fosite.Arguments{"openid", "profile"}, []string{"name", "nickname", "picture", "preferred_username", "sid"}},
+		{fosite.Arguments{"openid", "email"}, []string{"email", "email_verified", "sid"}},
+		{fosite.Arguments{"openid", "groups"}, []string{"groups", "sid", "tenant"}},
+		{fosite.Arguments{"openid", "roles"}, []string{"roles", "sid"}},
+		{fosite.Arguments{"openid", "email", "roles"}, []string{"email", "email_verified", "roles", "sid"}},
+		{fosite.Arguments{"openid", "profile", "email", "groups", "roles"}, []string{"email", "email_verified", "groups", "name", "nickname", "picture", "preferred_username", "roles", "sid", "tenant"}},
+	} {
+		t.Run(strings.Join(tc.granted, " "), func(t *testing.T) {
+			if got := claimNames(releaseClaims(claims, tc.granted, mappings)); !slices.Equal(got, tc.want) {
+				t.Errorf("released %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIntrospectionSession(t *testing.T) {
+	session := &openid.DefaultSession{Claims: &jwt.IDTokenClaims{Extra: map[string]interface{}{
+		"sid":    "session",
+		"email":  "alice@example.com",
+		"groups": []string{"team"},
+		"rank":   "trainer",
+	}}}
+	mappings := ClaimMappings{"rank": {Field: "title", Scope: "email"}}
+	s := &introspectionSession{session, fosite.Arguments{"openid", "email"}, mappings}
+	if got := claimNames(s.GetExtraClaims()); !slices.Equal(got, []string{"email", "rank", "sid"}) {
+		t.Errorf("introspection released %v", got)
+	}
+	if session.Claims.Extra["groups"] == nil {
+		t.Error("claims of the session were modified")
+	}
+
+	s = &introspectionSession{&openid.DefaultSession{}, fosite.Arguments{"openid"}, nil}
+	if got := s.GetExtraClaims(); got != nil {
+		t.Errorf("session without claims released %v", got)
+	}
+}
+
+func claimNames(claims map[string]interface{}) []string {
+	names := make([]string, 0, len(claims))
+	for name := range claims {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/parkour-vienna/distrust/cryptutils"
+)
+
+// keySigner signs tokens with the active key of a KeySet and verifies tokens
+// with any published key. Unlike jwt.DefaultSigner it supports all key types
+// of the key set and hashes tokens according to the algorithm of the active key.
+type keySigner struct {
+	keys *KeySet
+}
+
+var _ jwt.Signer = (*keySigner)(nil)
+
+func (s *keySigner) Generate(ctx context.Context, claims jwt.MapClaims, header jwt.Mapper) (string, string, error) {
+	signer := &jwt.DefaultSigner{GetPrivateKey: s.keys.SigningKey}
+	return signer.Generate(ctx, claims, header)
+}
+
+func (s *keySigner) Validate(ctx context.Context, token string) (string, error) {
+	if _, err := s.Decode(ctx, token); err != nil {
+		return "", err
+	}
+	return s.GetSignature(ctx, token)
+}
+
+func (s *keySigner) Decode(ctx context.Context, token string) (*jwt.Token, error) {
+	return jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no key id")
+		}
+		pub, err := s.keys.verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// fosite converts non pointer keys to pointers, which go-jose does not accept
+		// for ed25519 keys, so the key is wrapped in a json web key
+		return &jose.JSONWebKey{Key: pub}, nil
+	})
+}
+
+func (s *keySigner) GetSignature(ctx context.Context, token string) (string, error) {
+	return (&jwt.DefaultSigner{}).GetSignature(ctx, token)
+}
+
+func (s *keySigner) Hash(ctx context.Context, in []byte) ([]byte, error) {
+	h := cryptutils.HashFor(s.keys.activeAlgorithm()).New()
+	h.Write(in)
+	return h.Sum(nil), nil
+}
+
+func (s *keySigner) GetSigningMethodLength(ctx context.Context) int {
+	return cryptutils.HashFor(s.keys.activeAlgorithm()).Size()
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/parkour-vienna/distrust/cryptutils"
+	"github.com/rs/zerolog/log"
+)
+
+const ssoCookie = "distrust_sso"
+
+// ssoSession is the login of a browser at distrust. It is sealed into a cookie, so further
+// authorize requests of the browser are answered without a discourse round trip.
+type ssoSession struct {
+	// Values is the verified discourse payload of the login
+	Values url.Values `json:"values"`
+	// SessionID is the sid of all logins made with this session
+	SessionID string `json:"sid"`
+	AuthTime  int64  `json:"auth_time"`
+	Expires   int64  `json:"exp"`
+}
+
+func (o *OIDCProvider) setSSOSession(rw http.ResponseWriter, req *http.Request, values url.Values, sid string, authTime time.Time) error {
+	expiration := authTime.Add(o.ssoLifetime)
+	raw, err := json.Marshal(&ssoSession{
+		Values:    values,
+		SessionID: sid,
+		AuthTime:  authTime.Unix(),
+		Expires:   expiration.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := cryptutils.Seal(o.ssoKey, raw)
+	if err != nil {
+		return fmt.Errorf("sealing sso session: %w", err)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    sealed,
+		Path:     o.root,
+		Expires:  expiration,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// getSSOSession restores the sso session of the browser. Sessions are only valid as long as the
+// logins made with them are stored, so logouts and revocations end them on all browsers.
+func (o *OIDCProvider) getSSOSession(ctx context.Context, req *http.Request) (*ssoSession, error) {
+	cookie, err := req.Cookie(ssoCookie)
+	if err != nil {
+		return nil, fmt.Errorf("fetching cookie: %w", err)
+	}
+	raw, err := cryptutils.Open(o.ssoKey, cookie.Value)
+	if err != nil {
+		return nil, fmt.Errorf("opening sso cookie: %w", err)
+	}
+	var s ssoSession
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("parsing sso cookie: %w", err)
+	}
+	if time.Now().After(time.Unix(s.Expires, 0)) {
+		return nil, errors.New("sso session expired")
+	}
+	logins, err := o.store.ListLogins(ctx, s.Values.Get("external_id"))
+	if err != nil {
+		return nil, fmt.Errorf("listing logins: %w", err)
+	}
+	for _, login := range logins {
+		if login.SessionID == s.SessionID {
+			return &s, nil
+		}
+	}
+	return nil, errors.New("sso session ended")
+}
+
+func (o *OIDCProvider) clearSSOSession(rw http.ResponseWriter, req *http.Request) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     ssoCookie,
+		Path:     o.root,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ssoEnabled reports whether browsers keep a session after logging in
+func (o *OIDCProvider) ssoEnabled() bool {
+	return o.ssoLifetime > 0
+}
+
+// resumeSSOSession returns the sso session of the browser if the authorize request can be answered
+// with it. Sessions older than the session lifespan of the client require a new login. If users are
+// synced with discourse, the user data of the session is reloaded, and users which can not be loaded
+// have to log in at discourse again.
+func (o *OIDCProvider) resumeSSOSession(ctx context.Context, req *http.Request, lifespans Lifespans) *ssoSession {
+	if !o.ssoEnabled() {
+		return nil
+	}
+	s, err := o.getSSOSession(ctx, req)
+	if err != nil {
+		if !errors.Is(err, http.ErrNoCookie) {
+			log.Debug().Err(err).Msg("ignoring sso session")
+		}
+		return nil
+	}
+	if lifespans.Session != 0 && time.Now().After(time.Unix(s.AuthTime, 0).Add(lifespans.Session)) {
+		return nil
+	}
+	if o.discourseResync && o.discourseAPI != nil {
+		values, err := o.currentUser(ctx, s.Values.Get("external_id"), s.Values)
+		if err != nil {
+			log.Info().Err(err).Str("subject", s.Values.Get("external_id")).Msg("ignoring sso session of user who can not be synced")
+			return nil
+		}
+		s.Values = values
+	}
+	return s
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/discourse"
+)
+
+// ssoTest logs users of a public test client in with a browser keeping its sso session
+type ssoTest struct {
+	t       *testing.T
+	o       *OIDCProvider
+	srv     *httptest.Server
+	browser *http.Client
+	// direct is the browser, but stops at redirects to discourse
+	direct *http.Client
+}
+
+func newSSOTest(t *testing.T, user url.Values, opts ...OIDCOption) *ssoTest {
+	disc := newDiscourseStub(t, user)
+	o, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "test",
+			Public:        true,
+			RedirectURIs:  []string{"https://rp.example.com/cb"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scopes:        []string{"openid", "profile"},
+		}},
+	}, append([]OIDCOption{WithSSOSession(time.Hour)}, opts...)...)
+	browser := newBrowser(t, srv, disc)
+	direct := &http.Client{
+		Jar: browser.Jar,
+		CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+			if req.URL.Scheme+"://"+req.URL.Host != srv.URL {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	return &ssoTest{t: t, o: o, srv: srv, browser: browser, direct: direct}
+}
+
+// login authorizes with browser and returns the id token claims, or nil if the login did not reach the client
+func (s *ssoTest) login(browser *http.Client) map[string]interface{} {
+	s.t.Helper()
+	loc := authorize(s.t, browser, s.srv, url.Values{
+		"client_id":             {"test"},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile"},
+		"redirect_uri":          {"https://rp.example.com/cb"},
+		"state":                 {"some-state-value"},
+		"nonce":                 {"some-nonce-value"},
+		"code_challenge":        {pkceVerifier},
+		"code_challenge_method": {"plain"},
+	})
+	if loc.Host != "rp.example.com" || loc.Query().Get("code") == "" {
+		return nil
+	}
+	body := exchangeCode(s.t, s.srv, "test", "", url.Values{
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"code_verifier": {pkceVerifier},
+	})
+	return idTokenClaims(s.t, body)
+}
+
+func TestSSOSessionResume(t *testing.T) {
+	user := url.Values{"external_id": {"42"}, "username": {"alice"}, "name": {"Alice"}}
+	s := newSSOTest(t, user)
+
+	if s.login(s.direct) != nil {
+		t.Fatal("login without sso session did not go to discourse")
+	}
+	first := s.login(s.browser)
+	if first == nil {
+		t.Fatal("login failed")
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// the session is resumed without discourse, with the user data of the login
+	user.Set("name", "Alice Renamed")
+	resumed := s.login(s.direct)
+	if resumed == nil {
+		t.Fatal("sso session was not resumed")
+	}
+	if resumed["sid"] != first["sid"] || resumed["auth_time"] != first["auth_time"] {
+		t.Errorf("resumed login has sid %v and auth_time %v, want %v and %v", resumed["sid"], resumed["auth_time"], first["sid"], first["auth_time"])
+	}
+	if resumed["name"] != "Alice" {
+		t.Errorf("resumed login has name %v, want the name of the login", resumed["name"])
+	}
+
+	// the session ends with the logins made with it
+	if err := s.o.store.DeleteLogins(t.Context(), "42"); err != nil {
+		t.Fatal(err)
+	}
+	if s.login(s.direct) != nil {
+		t.Fatal("sso session without stored logins was resumed")
+	}
+	if again := s.login(s.browser); again == nil || again["sid"] == first["sid"] {
+		t.Errorf("new login reused the ended session: %v", again)
+	}
+}
+
+func TestSSOSessionExpiry(t *testing.T) {
+	s := newSSOTest(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+	if s.login(s.browser) == nil {
+		t.Fatal("login failed")
+	}
+	cookies := s.browser.Jar.Cookies(&url.URL{Scheme: "http", Host: s.srv.Listener.Addr().String(), Path: s.o.root})
+	var sso *http.Cookie
+	for _, c := range cookies {
+		if c.Name == ssoCookie {
+			sso = c
+		}
+	}
+	if sso == nil {
+		t.Fatal("no sso session stored")
+	}
+	session := func(cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+		req.AddCookie(cookie)
+		return req
+	}
+	stored, err := s.o.getSSOSession(t.Context(), session(sso))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session of the same login, but started two hours ago
+	rec := httptest.NewRecorder()
+	s.o.ssoLifetime = 3 * time.Hour
+	if err := s.o.setSSOSession(rec, session(sso), stored.Values, stored.SessionID, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	old := rec.Result().Cookies()[0]
+	if s.o.resumeSSOSession(t.Context(), session(old), Lifespans{}) == nil {
+		t.Error("session within its lifetime was not resumed")
+	}
+	if s.o.resumeSSOSession(t.Context(), session(old), Lifespans{Session: time.Hour}) != nil {
+		t.Error("session older than the session lifespan of the client was resumed")
+	}
+
+	s.o.ssoLifetime = time.Hour
+	rec = httptest.NewRecorder()
+	if err := s.o.setSSOSession(rec, session(sso), stored.Values, stored.SessionID, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.o.getSSOSession(t.Context(), session(rec.Result().Cookies()[0])); err == nil {
+		t.Error("expired sso session was accepted")
+	}
+
+	// modified sessions are rejected
+	forged := *sso
+	forged.Value = sso.Value[:len(sso.Value)-4] + "AAAA"
+	if _, err := s.o.getSSOSession(t.Context(), session(&forged)); err == nil {
+		t.Error("modified sso session was accepted")
+	}
+}
+
+func TestSSOSessionResync(t *testing.T) {
+	current := map[string]interface{}{
+		"id":       42,
+		"username": "alice",
+		"name":     "Alice Renamed",
+		"active":   true,
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/admin/users/42.json" {
+			http.NotFound(rw, req)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(current)
+	}))
+	t.Cleanup(api.Close)
+	s := newSSOTest(t, url.Values{"external_id": {"42"}, "username": {"alice"}, "name": {"Alice"}},
+		WithDiscourseAPI(discourse.NewAPIClient(api.URL, "key", "system")), WithDiscourseResync(true))
+
+	if s.login(s.browser) == nil {
+		t.Fatal("login failed")
+	}
+	resumed := s.login(s.direct)
+	if resumed == nil {
+		t.Fatal("sso session was not resumed")
+	}
+	if resumed["name"] != "Alice Renamed" {
+		t.Errorf("resumed login has name %v, want the current name", resumed["name"])
+	}
+
+	// suspended users have to log in at discourse
+	current["suspended_till"] = time.Now().Add(time.Hour).Format(time.RFC3339)
+	if s.login(s.direct) != nil {
+		t.Error("sso session of a suspended user was resumed")
+	}
+}
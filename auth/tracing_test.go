@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestLoginSpans(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewProvider("distrust", 1, sdktrace.WithSyncer(exp)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	disc := newDiscourseStub(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+	_, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "test",
+			Public:        true,
+			RedirectURIs:  []string{"https://rp.example.com/cb"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scopes:        []string{"openid"},
+		}},
+	})
+	loc := authorize(t, newBrowser(t, srv, disc), srv, url.Values{
+		"client_id":             {"test"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"redirect_uri":          {"https://rp.example.com/cb"},
+		"state":                 {"some-state-value"},
+		"nonce":                 {"some-nonce-value"},
+		"code_challenge":        {"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"},
+		"code_challenge_method": {"plain"},
+	})
+	body := exchangeCode(t, srv, "test", "", url.Values{
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"code_verifier": {"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"},
+	})
+	if body["access_token"] == nil {
+		t.Fatalf("token request failed: %v", body)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+	for _, name := range []string{"authorize", "discourse", "callback", "token"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("span %s missing", name)
+		}
+	}
+	// the discourse round trip belongs to the trace of the authorize request
+	if d, a := spans["discourse"], spans["authorize"]; d.Parent.SpanID() != a.SpanContext.SpanID() {
+		t.Errorf("discourse span is not a child of the authorize span")
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/parkour-vienna/distrust/cryptutils"
+)
+
+// UserSession is the identity of a user who logged in through discourse. It is sealed into a cookie
+// on the protected host, so no server side state is needed.
+type UserSession struct {
+	Subject  string   `json:"sub"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups"`
+	Expires  int64    `json:"exp"`
+}
+
+// loginState is the state of a login between the redirect to discourse and the callback
+type loginState struct {
+	Nonce    int    `json:"nonce"`
+	Redirect string `json:"rd"`
+	Expires  int64  `json:"exp"`
+}
+
+// sessionCookies stores user sessions and login states in sealed cookies
+type sessionCookies struct {
+	key      []byte
+	name     string
+	lifetime time.Duration
+}
+
+func newSessionCookies(secret []byte, name string, lifetime time.Duration) *sessionCookies {
+	return &sessionCookies{
+		key:      cryptutils.DeriveKey(secret, "distrust user session "+name),
+		name:     name,
+		lifetime: lifetime,
+	}
+}
+
+func (c *sessionCookies) setState(rw http.ResponseWriter, secure bool, nonce int, redirect string) error {
+	expiration := time.Now().Add(inflightLifetime)
+	return c.set(rw, c.name+"_state", secure, expiration, &loginState{
+		Nonce:    nonce,
+		Redirect: redirect,
+		Expires:  expiration.Unix(),
+	})
+}
+
+// getState restores and removes the login state
+func (c *sessionCookies) getState(rw http.ResponseWriter, req *http.Request, secure bool) (*loginState, error) {
+	var state loginState
+	if err := c.get(req, c.name+"_state", &state); err != nil {
+		return nil, err
+	}
+	c.clear(rw, c.name+"_state", secure)
+	if time.Now().After(time.Unix(state.Expires, 0)) {
+		return nil, errors.New("login expired")
+	}
+	return &state, nil
+}
+
+// setSession stores the user from a validated discourse response
+func (c *sessionCookies) setSession(rw http.ResponseWriter, secure bool, values url.Values) (*UserSession, error) {
+	expiration := time.Now().Add(c.lifetime)
+	session := &UserSession{
+		Subject:  values.Get("external_id"),
+		Username: values.Get("username"),
+		Email:    values.Get("email"),
+		Groups:   strings.Split(values.Get("groups"), ","),
+		Expires:  expiration.Unix(),
+	}
+	return session, c.set(rw, c.name, secure, expiration, session)
+}
+
+func (c *sessionCookies) getSession(req *http.Request) (*UserSession, error) {
+	var session UserSession
+	if err := c.get(req, c.name, &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(time.Unix(session.Expires, 0)) {
+		return nil, errors.New("session expired")
+	}
+	return &session, nil
+}
+
+func (c *sessionCookies) clearSession(rw http.ResponseWriter, secure bool) {
+	c.clear(rw, c.name, secure)
+}
+
+func (c *sessionCookies) set(rw http.ResponseWriter, name string, secure bool, expiration time.Time, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sealed, err := cryptutils.Seal(c.key, raw)
+	if err != nil {
+		return fmt.Errorf("sealing cookie: %w", err)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    sealed,
+		Path:     "/",
+		Expires:  expiration,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (c *sessionCookies) get(req *http.Request, name string, v interface{}) error {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return err
+	}
+	raw, err := cryptutils.Open(c.key, cookie.Value)
+	if err != nil {
+		return fmt.Errorf("opening cookie: %w", err)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (c *sessionCookies) clear(rw http.ResponseWriter, name string, secure bool) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/parkour-vienna/distrust/audit"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook receives discourse webhooks and revokes the tokens of users who were suspended,
+// deleted, logged out or changed groups, notifying their clients through back-channel logout
+type Webhook struct {
+	oidc   *OIDCProvider
+	secret string
+}
+
+// NewWebhook creates a webhook receiver for payloads signed with secret
+func NewWebhook(o *OIDCProvider, secret string) *Webhook {
+	return &Webhook{oidc: o, secret: secret}
+}
+
+func (wh *Webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	event, err := discourse.ReadWebhook(req, wh.secret)
+	if errors.Is(err, discourse.ErrBadSignature) {
+		log.Warn().Err(err).Msg("rejecting discourse webhook")
+		writeWebhookStatus(rw, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("reading discourse webhook")
+		writeWebhookStatus(rw, http.StatusBadRequest, "malformed webhook")
+		return
+	}
+
+	switch event.Name {
+	case discourse.EventUserSuspended, discourse.EventUserDestroyed, discourse.EventUserLoggedOut,
+		discourse.EventUserAddedToGroup, discourse.EventUserRemovedFromGroup:
+	default:
+		metrics.Webhook(event.Name, false)
+		writeWebhookStatus(rw, http.StatusOK, "ignored")
+		return
+	}
+	if event.UserID == "" {
+		log.Warn().Str("event", event.Name).Str("id", event.ID).Msg("discourse webhook without user")
+		writeWebhookStatus(rw, http.StatusBadRequest, "missing user")
+		return
+	}
+
+	ctx := req.Context()
+	log.Info().Str("event", event.Name).Str("id", event.ID).Str("subject", event.UserID).Msg("revoking tokens for discourse webhook")
+	// the discourse sessions are not ended here, logging out of discourse triggers another webhook
+	if err := wh.oidc.store.RevokeSubject(ctx, event.UserID); err != nil {
+		log.Error().Err(err).Str("subject", event.UserID).Msg("revoking tokens")
+		writeWebhookStatus(rw, http.StatusInternalServerError, "revoking tokens failed")
+		return
+	}
+	wh.oidc.backchannelLogout(ctx, event.UserID)
+	metrics.Webhook(event.Name, true)
+	wh.oidc.audit.Log(req, audit.Event{Type: audit.TokenRevoked, Subject: event.UserID, Reason: "discourse webhook " + event.Name})
+	writeWebhookStatus(rw, http.StatusOK, "revoked")
+}
+
+func writeWebhookStatus(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(map[string]string{"status": message})
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/discourse"
+)
+
+const testWebhookSecret = "some-webhook-secret"
+
+// sendWebhook delivers the discourse event with body to wh, signed with secret, and returns the status
+func sendWebhook(t *testing.T, wh *Webhook, event, body, secret string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/discourse/webhook", strings.NewReader(body))
+	req.Header.Set("X-Discourse-Event", event)
+	req.Header.Set("X-Discourse-Event-Id", "17")
+	if secret != "" {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(body))
+		req.Header.Set("X-Discourse-Event-Signature", "sha256="+hex.EncodeToString(h.Sum(nil)))
+	}
+	rec := httptest.NewRecorder()
+	wh.ServeHTTP(rec, req)
+	var resp struct {
+		Status string `json:"status"`
+	}
+	_ = json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp.Status
+}
+
+func TestWebhook(t *testing.T) {
+	disc := newDiscourseStub(t, url.Values{"external_id": {"42"}, "username": {"alice"}})
+	o, srv := newTestProvider(t, disc.URL, map[string]fosite.Client{
+		"test": &DistrustClient{DefaultClient: fosite.DefaultClient{
+			ID:            "test",
+			Public:        true,
+			RedirectURIs:  []string{"https://rp.example.com/cb"},
+			ResponseTypes: []string{"code"},
+			GrantTypes:    []string{"authorization_code"},
+			Scopes:        []string{"openid"},
+		}},
+	})
+	wh := NewWebhook(o, testWebhookSecret)
+
+	loc := authorize(t, newBrowser(t, srv, disc), srv, url.Values{
+		"client_id":             {"test"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"redirect_uri":          {"https://rp.example.com/cb"},
+		"state":                 {"some-state-value"},
+		"nonce":                 {"some-nonce-value"},
+		"code_challenge":        {pkceVerifier},
+		"code_challenge_method": {"plain"},
+	})
+	body := exchangeCode(t, srv, "test", "", url.Values{
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"code_verifier": {pkceVerifier},
+	})
+	accessToken, _ := body["access_token"].(string)
+	// userinfo returns the subject of the access token, or nothing once it is revoked
+	userinfo := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/oauth2/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info struct {
+			Subject string `json:"sub"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&info)
+		return info.Subject
+	}
+	if sub := userinfo(); sub != "42" {
+		t.Fatalf("userinfo before the webhook: got subject %q", sub)
+	}
+	if logins, err := o.store.ListLogins(t.Context(), "42"); err != nil || len(logins) != 1 {
+		t.Fatalf("got logins %v %v, want the login of the client", logins, err)
+	}
+
+	suspended := `{"user":{"id":42,"username":"alice"}}`
+	if status, _ := sendWebhook(t, wh, discourse.EventUserSuspended, suspended, ""); status != http.StatusUnauthorized {
+		t.Errorf("webhook without signature: got %d", status)
+	}
+	if status, _ := sendWebhook(t, wh, discourse.EventUserSuspended, suspended, "wrong-secret"); status != http.StatusUnauthorized {
+		t.Errorf("webhook with wrong signature: got %d", status)
+	}
+	if status, _ := sendWebhook(t, wh, discourse.EventUserSuspended, `{"user":`, testWebhookSecret); status != http.StatusBadRequest {
+		t.Errorf("malformed webhook: got %d", status)
+	}
+	if status, _ := sendWebhook(t, wh, discourse.EventUserSuspended, `{"post":{"id":1}}`, testWebhookSecret); status != http.StatusBadRequest {
+		t.Errorf("webhook without user: got %d", status)
+	}
+	if status, msg := sendWebhook(t, wh, "post_created", `{"post":{"id":1,"user_id":42}}`, testWebhookSecret); status != http.StatusOK || msg != "ignored" {
+		t.Errorf("ignored event: got %d %q", status, msg)
+	}
+	if userinfo() != "42" {
+		t.Fatal("rejected or ignored webhook revoked the tokens")
+	}
+
+	// group changes are sent as group_user records
+	groupUser := `{"group_user":{"id":7,"group_id":3,"user_id":42}}`
+	if status, msg := sendWebhook(t, wh, discourse.EventUserRemovedFromGroup, groupUser, testWebhookSecret); status != http.StatusOK || msg != "revoked" {
+		t.Fatalf("group webhook: got %d %q", status, msg)
+	}
+	if userinfo() != "" {
+		t.Error("access token is still valid after the webhook")
+	}
+	if logins, err := o.store.ListLogins(t.Context(), "42"); err != nil || len(logins) != 0 {
+		t.Errorf("logins were not deleted: %v %v", logins, err)
+	}
+}
@@ -2,14 +2,227 @@ package cryptutils
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	jose "github.com/go-jose/go-jose/v3"
 )
 
-func KeyID(pub rsa.PublicKey) string {
-	der := x509.MarshalPKCS1PublicKey(&pub)
+// KeyID derives a stable key id from a public key
+func KeyID(pub crypto.PublicKey) string {
+	var der []byte
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		// rsa keys keep their PKCS1 based id, so ids of existing keys do not change
+		der = x509.MarshalPKCS1PublicKey(k)
+	case rsa.PublicKey:
+		der = x509.MarshalPKCS1PublicKey(&k)
+	default:
+		der, _ = x509.MarshalPKIXPublicKey(pub)
+	}
 	h := crypto.SHA256.New()
 	h.Write(der)
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))[:32]
 }
+
+// Algorithm returns the JWS algorithm used for signing with the given key
+func Algorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// HashFor returns the hash used for token hashes like at_hash with the given algorithm
+func HashFor(alg jose.SignatureAlgorithm) crypto.Hash {
+	switch alg {
+	case jose.RS384, jose.ES384, jose.PS384:
+		return crypto.SHA384
+	case jose.RS512, jose.ES512, jose.PS512, jose.EdDSA:
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+// KeySpec describes the type and size of a private key
+type KeySpec struct {
+	// Type is one of rsa, ec or ed25519
+	Type string
+	// Bits is the key size for rsa keys and the curve size for ec keys. It is ignored for ed25519 keys.
+	Bits int
+}
+
+func (s KeySpec) Validate() error {
+	switch s.Type {
+	case "", "rsa":
+		if s.Bits != 0 && s.Bits < 2048 {
+			return errors.New("rsa keys must be at least 2048 bits")
+		}
+	case "ec":
+		if _, err := curve(s.Bits); err != nil {
+			return err
+		}
+	case "ed25519":
+	default:
+		return fmt.Errorf("unknown key type %q", s.Type)
+	}
+	return nil
+}
+
+// Generate creates a new private key matching the spec
+func (s KeySpec) Generate() (crypto.Signer, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	switch s.Type {
+	case "ec":
+		c, _ := curve(s.Bits)
+		return ecdsa.GenerateKey(c, rand.Reader)
+	case "ed25519":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		bits := s.Bits
+		if bits == 0 {
+			bits = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+}
+
+func curve(bits int) (elliptic.Curve, error) {
+	switch bits {
+	case 0, 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported ec key size %d, use 256, 384 or 521", bits)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS1, PKCS8 or SEC1 private key
+func ParsePrivateKey(raw []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		return key, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		if _, err := Algorithm(signer); err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+}
+
+// EncodePrivateKey encodes a private key as PEM. RSA keys are encoded as PKCS1, EC keys as SEC1
+// and all other keys as PKCS8.
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// DeriveKey derives a 32 byte key for the given purpose from a shared secret
+func DeriveKey(secret []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// Seal encrypts and authenticates plaintext with AES-GCM and returns a url safe string
+func Seal(key, plaintext []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Open decrypts a value created by Seal and verifies its integrity
+func Open(key []byte, sealed string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decoding sealed value: %w", err)
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,140 @@
+package discourse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by the api client if the requested resource does not exist
+var ErrNotFound = errors.New("not found in discourse")
+
+// APIClient talks to the discourse admin api. The api key needs to be a global key
+// or a granular key with the scopes required by the used methods.
+type APIClient struct {
+	Server   string
+	Key      string
+	Username string
+	HTTP     *http.Client
+}
+
+func NewAPIClient(server, key, username string) *APIClient {
+	return &APIClient{
+		Server:   strings.TrimSuffix(server, "/"),
+		Key:      key,
+		Username: username,
+		HTTP:     &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// LogOut ends all discourse sessions of the user with the given id
+func (c *APIClient) LogOut(ctx context.Context, userID string) error {
+	return c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(userID)+"/log_out.json", nil)
+}
+
+// User is a discourse user as returned by the admin api
+type User struct {
+	ID             int        `json:"id"`
+	Username       string     `json:"username"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	AvatarTemplate string     `json:"avatar_template"`
+	Active         bool       `json:"active"`
+	Admin          bool       `json:"admin"`
+	Moderator      bool       `json:"moderator"`
+	SuspendedTill  *time.Time `json:"suspended_till"`
+	Groups         []struct {
+		Name string `json:"name"`
+	} `json:"groups"`
+}
+
+// GetUser loads the user with the given id, which is the external_id of DiscourseConnect payloads
+func (c *APIClient) GetUser(ctx context.Context, userID string) (*User, error) {
+	var u User
+	if err := c.do(ctx, http.MethodGet, "/admin/users/"+url.PathEscape(userID)+".json", &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Suspended reports whether the user is suspended at t
+func (u *User) Suspended(t time.Time) bool {
+	return u.SuspendedTill != nil && u.SuspendedTill.After(t)
+}
+
+// Values returns the user in the format of a DiscourseConnect payload. The admin api does not
+// always include the email, in which case it is empty.
+func (u *User) Values(server string) url.Values {
+	groups := make([]string, 0, len(u.Groups))
+	for _, g := range u.Groups {
+		groups = append(groups, g.Name)
+	}
+	avatar := strings.ReplaceAll(u.AvatarTemplate, "{size}", "240")
+	if strings.HasPrefix(avatar, "/") {
+		avatar = strings.TrimSuffix(server, "/") + avatar
+	}
+	return url.Values{
+		"external_id": {strconv.Itoa(u.ID)},
+		"username":    {u.Username},
+		"name":        {u.Name},
+		"email":       {u.Email},
+		"avatar_url":  {avatar},
+		"groups":      {strings.Join(groups, ",")},
+		"admin":       {strconv.FormatBool(u.Admin)},
+		"moderator":   {strconv.FormatBool(u.Moderator)},
+	}
+}
+
+// CheckStatus checks that the discourse server is up using its status endpoint
+func CheckStatus(ctx context.Context, client *http.Client, server string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+"/srv/status", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling discourse: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discourse status returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *APIClient) do(ctx context.Context, method, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", c.Key)
+	req.Header.Set("Api-Username", c.Username)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling discourse api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discourse api returned %s: %s", resp.Status, string(body))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding discourse api response: %w", err)
+	}
+	return nil
+}
@@ -12,13 +12,31 @@ import (
 	"strconv"
 )
 
+var (
+	// ErrBadSignature is returned for responses which were not signed with the shared secret
+	ErrBadSignature = errors.New("wrong signature from discourse")
+	// ErrBadNonce is returned for responses to a different login
+	ErrBadNonce = errors.New("wrong nonce from discourse")
+	// ErrLoginRequired is returned if the user was not logged in to discourse for a login with prompt=none
+	ErrLoginRequired = errors.New("user is not logged in to discourse")
+)
+
 type SSOConfig struct {
 	Server string
 	Secret string
 }
 
 func GenerateURL(server, callback, key string, nonce int) string {
+	return GenerateURLWithPrompt(server, callback, key, nonce, "")
+}
+
+// GenerateURLWithPrompt generates the login url with a DiscourseConnect prompt. With prompt none,
+// discourse does not ask for credentials and fails the login if the user is not logged in.
+func GenerateURLWithPrompt(server, callback, key string, nonce int, prompt string) string {
 	payload := fmt.Sprintf("nonce=%d&return_sso_url=%s", nonce, callback)
+	if prompt != "" {
+		payload += "&prompt=" + url.QueryEscape(prompt)
+	}
 	rk := []byte(key)
 	bpl := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
 	base64.StdEncoding.Encode(bpl, []byte(payload))
@@ -38,11 +56,11 @@ func ValidateResponse(sso, sig, key string, nonce int) (url.Values, error) {
 
 	rsig, err := hex.DecodeString(sig)
 	if err != nil {
-		return nil, fmt.Errorf("decoding signature: %w", err)
+		return nil, fmt.Errorf("decoding signature: %w: %w", ErrBadSignature, err)
 	}
 
 	if !bytes.Equal(h.Sum(nil), rsig) {
-		return nil, errors.New("wrong signature from discourse")
+		return nil, ErrBadSignature
 	}
 
 	qs, err := base64.StdEncoding.DecodeString(sso)
@@ -60,7 +78,10 @@ func ValidateResponse(sso, sig, key string, nonce int) (url.Values, error) {
 	}
 
 	if rnonce != nonce {
-		return nil, errors.New("wrong nonce from discourse")
+		return nil, ErrBadNonce
+	}
+	if values.Get("failed") == "true" {
+		return nil, ErrLoginRequired
 	}
 
 	return values, nil
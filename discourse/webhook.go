@@ -0,0 +1,81 @@
+package discourse
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxWebhookSize limits the size of webhook payloads
+const maxWebhookSize = 1 << 20
+
+// Webhook events which affect the access of a user
+const (
+	EventPing                 = "ping"
+	EventUserSuspended        = "user_suspended"
+	EventUserDestroyed        = "user_destroyed"
+	EventUserLoggedOut        = "user_logged_out"
+	EventUserAddedToGroup     = "user_added_to_group"
+	EventUserRemovedFromGroup = "user_removed_from_group"
+)
+
+// WebhookEvent is a verified webhook delivery
+type WebhookEvent struct {
+	// ID is the id of the delivery, which is the same for retries
+	ID string
+	// Name is the event, e.g. user_suspended
+	Name string
+	// UserID is the id of the user the event is about, which is the external_id of DiscourseConnect payloads
+	UserID string
+}
+
+// ReadWebhook verifies that the webhook request was signed with secret and decodes the event
+func ReadWebhook(req *http.Request, secret string) (*WebhookEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading webhook: %w", err)
+	}
+	sig, ok := strings.CutPrefix(req.Header.Get("X-Discourse-Event-Signature"), "sha256=")
+	if !ok {
+		return nil, ErrBadSignature
+	}
+	rsig, err := hex.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w: %w", ErrBadSignature, err)
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	if !hmac.Equal(h.Sum(nil), rsig) {
+		return nil, ErrBadSignature
+	}
+
+	event := &WebhookEvent{
+		ID:   req.Header.Get("X-Discourse-Event-Id"),
+		Name: req.Header.Get("X-Discourse-Event"),
+	}
+	// user events contain the user, group membership events the group_user record
+	var payload struct {
+		User *struct {
+			ID int `json:"id"`
+		} `json:"user"`
+		GroupUser *struct {
+			UserID int `json:"user_id"`
+		} `json:"group_user"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("decoding webhook: %w", err)
+	}
+	switch {
+	case payload.User != nil:
+		event.UserID = strconv.Itoa(payload.User.ID)
+	case payload.GroupUser != nil:
+		event.UserID = strconv.Itoa(payload.GroupUser.UserID)
+	}
+	return event, nil
+}
@@ -0,0 +1,76 @@
+package discourse
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWebhookSecret = "some-webhook-secret"
+
+func TestReadWebhook(t *testing.T) {
+	sign := func(body string) string {
+		h := hmac.New(sha256.New, []byte(testWebhookSecret))
+		h.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(h.Sum(nil))
+	}
+	for _, tc := range []struct {
+		name      string
+		event     string
+		body      string
+		signature string
+		user      string
+		err       error
+	}{
+		{"user event", EventUserSuspended, `{"user":{"id":42,"username":"alice"}}`, "", "42", nil},
+		{"group membership", EventUserAddedToGroup, `{"group_user":{"id":7,"group_id":3,"user_id":42}}`, "", "42", nil},
+		{"event without user", EventPing, `{"ping":"OK"}`, "", "", nil},
+		{"missing signature", EventUserSuspended, `{"user":{"id":42}}`, "-", "", ErrBadSignature},
+		{"wrong secret", EventUserSuspended, `{"user":{"id":42}}`, "sha256=" + strings.Repeat("ab", 32), "", ErrBadSignature},
+		{"signature without algorithm", EventUserSuspended, `{"user":{"id":42}}`, strings.Repeat("ab", 32), "", ErrBadSignature},
+		{"malformed signature", EventUserSuspended, `{"user":{"id":42}}`, "sha256=not-hex", "", ErrBadSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/discourse/webhook", strings.NewReader(tc.body))
+			req.Header.Set("X-Discourse-Event", tc.event)
+			req.Header.Set("X-Discourse-Event-Id", "17")
+			switch tc.signature {
+			case "":
+				req.Header.Set("X-Discourse-Event-Signature", sign(tc.body))
+			case "-":
+			default:
+				req.Header.Set("X-Discourse-Event-Signature", tc.signature)
+			}
+			event, err := ReadWebhook(req, testWebhookSecret)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Name != tc.event || event.ID != "17" || event.UserID != tc.user {
+				t.Errorf("got event %+v, want %s about user %q", event, tc.event, tc.user)
+			}
+		})
+	}
+
+	// the body is signed, so it can not be changed
+	req := httptest.NewRequest(http.MethodPost, "/discourse/webhook", strings.NewReader(`{"user":{"id":1}}`))
+	req.Header.Set("X-Discourse-Event-Signature", sign(`{"user":{"id":42}}`))
+	if _, err := ReadWebhook(req, testWebhookSecret); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("modified body: got error %v", err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/discourse/webhook", strings.NewReader(`{"user":`))
+	req.Header.Set("X-Discourse-Event-Signature", sign(`{"user":`))
+	if _, err := ReadWebhook(req, testWebhookSecret); err == nil || errors.Is(err, ErrBadSignature) {
+		t.Errorf("malformed body: got error %v", err)
+	}
+}
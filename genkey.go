@@ -1,22 +1,29 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"flag"
 	"log"
 	"os"
+
+	"github.com/parkour-vienna/distrust/cryptutils"
 )
 
 func genkey() {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	flags := flag.NewFlagSet("genkey", flag.ExitOnError)
+	keyType := flags.String("type", "rsa", "type of the key: rsa, ec or ed25519")
+	bits := flags.Int("bits", 0, "key size for rsa keys (default 2048) or curve size for ec keys (256, 384 or 521)")
+	_ = flags.Parse(os.Args[2:])
+
+	priv, err := cryptutils.KeySpec{Type: *keyType, Bits: *bits}.Generate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := cryptutils.EncodePrivateKey(priv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = os.Stdout.Write(out)
 	if err != nil {
 		log.Fatal(err)
 	}
-	out := x509.MarshalPKCS1PrivateKey(priv)
-	log.Fatal(pem.Encode(os.Stdout, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: out,
-	}))
 }
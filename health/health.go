@@ -0,0 +1,114 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// checkTimeout limits the time all readiness checks may take together
+const checkTimeout = time.Second * 5
+
+// Check reports why a dependency is not ready
+type Check func(ctx context.Context) error
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Handler serves liveness, readiness and version endpoints
+type Handler struct {
+	checks map[string]Check
+	build  BuildInfo
+}
+
+// New creates a handler for the given build. Missing commit and date are taken
+// from the version control information embedded by the go toolchain.
+func New(build BuildInfo) *Handler {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build.GoVersion = info.GoVersion
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && build.Commit == "":
+				build.Commit = s.Value
+			case s.Key == "vcs.time" && build.Date == "":
+				build.Date = s.Value
+			}
+		}
+	}
+	return &Handler{checks: map[string]Check{}, build: build}
+}
+
+// AddCheck adds a check which has to pass for the service to be ready
+func (h *Handler) AddCheck(name string, check Check) {
+	h.checks[name] = check
+}
+
+// RegisterHandlers serves /healthz, /readyz and /version on r
+func (h *Handler) RegisterHandlers(r chi.Router) {
+	r.Get("/healthz", h.healthz)
+	r.Get("/readyz", h.readyz)
+	r.Get("/version", h.version)
+}
+
+func (h *Handler) healthz(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *Handler) readyz(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]string, len(h.checks))
+		ready   = true
+	)
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if err := check(ctx); err != nil {
+				log.Warn().Err(err).Str("check", name).Msg("readiness check failed")
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = result
+			ready = ready && result == "ok"
+		}()
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(rw, code, struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{status, results})
+}
+
+func (h *Handler) version(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, h.build)
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(v)
+}
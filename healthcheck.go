@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// healthcheck queries the liveness endpoint of the local server and exits with status 1 if it
+// does not answer. It can be used as a container health check in images without a shell.
+func healthcheck() {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	url := flags.String("url", "", "url to check (default: /healthz on the listenAddr)")
+	timeout := flags.Duration("timeout", time.Second*5, "timeout of the check")
+	_ = flags.Parse(os.Args[2:])
+
+	if *url == "" {
+		_, port, err := net.SplitHostPort(viper.GetString("listenAddr"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid listenAddr:", err)
+			os.Exit(1)
+		}
+		*url = "http://" + net.JoinHostPort("127.0.0.1", port) + "/healthz"
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(*url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "unhealthy:", resp.Status)
+		os.Exit(1)
+	}
+	fmt.Println("healthy")
+}
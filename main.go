@@ -1,20 +1,29 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/audit"
 	"github.com/parkour-vienna/distrust/auth"
+	"github.com/parkour-vienna/distrust/cryptutils"
 	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/health"
+	"github.com/parkour-vienna/distrust/metrics"
+	"github.com/parkour-vienna/distrust/policy"
 	"github.com/parkour-vienna/distrust/requestlog"
+	"github.com/parkour-vienna/distrust/storage"
+	"github.com/parkour-vienna/distrust/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -22,10 +31,44 @@ import (
 )
 
 type clientConfig struct {
-	Secret       string
-	RedirectURIs []string
-	AllowGroups  []string
-	DenyGroups   []string
+	Secret                  string
+	RedirectURIs            []string
+	PostLogoutRedirectURIs  []string
+	BackchannelLogoutURI    string
+	AllowGroups             []string
+	DenyGroups              []string
+	AllowRoles              []string
+	DenyRoles               []string
+	GrantTypes              []string
+	ResponseTypes           []string
+	Scopes                  []string
+	Audience                []string
+	TokenEndpointAuthMethod string
+	Public                  bool
+	PKCE                    string
+	Claims                  auth.ClaimMappings
+	Roles                   auth.RoleMappings
+	Policy                  string
+	Lifespans               auth.Lifespans
+}
+
+var (
+	defaultGrantTypes    = []string{"authorization_code", "refresh_token", "implicit"}
+	defaultResponseTypes = []string{"id_token", "code", "token", "id_token token", "code id_token", "code token", "code id_token token"}
+	defaultScopes        = []string{"openid", "profile", "email", "groups", "roles"}
+)
+
+// set by goreleaser
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+type protectedHost struct {
+	Host        string
+	AllowGroups []string
+	DenyGroups  []string
 }
 
 func main() {
@@ -33,50 +76,49 @@ func main() {
 		genkey()
 		return
 	}
-
-	viper.SetConfigName("distrust")
-	viper.AddConfigPath("/etc/distrust")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
-	if err != nil {
-		fmt.Println(err)
-		fmt.Printf("failed to load config file.\n" +
-			"A config file is required to run distrust. It should be located in `/etc/distrust` or the current working directory\n")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "policy" {
+		policyTest()
+		return
 	}
-	viper.SetEnvPrefix("distrust")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AutomaticEnv()
 
-	lvl, err := zerolog.ParseLevel(viper.GetString("log.level"))
-	if err != nil {
-		log.Fatal().Str("level", viper.GetString("log.level")).Msg("invalid log level")
-	}
-	zerolog.SetGlobalLevel(lvl)
+	loadConfig()
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if len(os.Args) > 1 && os.Args[1] == "rotatekeys" {
+		rotatekeys()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		proxy()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		healthcheck()
+		return
+	}
 
 	dsettings := discourse.SSOConfig{
 		Server: viper.GetString("discourse.server"),
 		Secret: viper.GetString("discourse.secret"),
 	}
 
+	shutdownTracing := setupTracing()
+
 	r := chi.NewRouter()
-	r.Use(requestlog.Zerologger)
+	r.Use(requestlog.Zerologger, metrics.Middleware)
 	r.Get("/", func(rw http.ResponseWriter, r *http.Request) {
 		http.Redirect(rw, r, dsettings.Server, http.StatusTemporaryRedirect)
 	})
 
 	// oauth2 setup
 	clients := map[string]clientConfig{}
-	err = viper.UnmarshalKey("clients", &clients)
+	err := viper.UnmarshalKey("clients", &clients)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to parse clients")
 	}
 	log.Info().Int("numClients", len(clients)).Msg("clients loaded")
 	options := []auth.OIDCOption{}
 	if viper.GetString("oidc.privatekey") != "" {
-		priv, err := parsePrivateKey(viper.GetString("oidc.privatekey"))
+		priv, err := cryptutils.ParsePrivateKey([]byte(viper.GetString("oidc.privatekey")))
 		if err != nil {
 			log.Warn().Err(err).Msg("failed to load private key")
 		} else {
@@ -86,51 +128,356 @@ func main() {
 	if viper.GetString("oidc.secret") != "" {
 		options = append(options, auth.WithSecret([]byte(viper.GetString("oidc.secret"))))
 	}
-	oidc := auth.NewOIDC("/oauth2", dsettings, toFositeClients(clients), options...)
+	spec := keySpec()
+	if err := spec.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid signing key configuration")
+	}
+	options = append(options, auth.WithKeySpec(spec))
+	if viper.GetDuration("oidc.keyRotation.interval") > 0 {
+		options = append(options, auth.WithKeyRotation(viper.GetDuration("oidc.keyRotation.interval")))
+	}
+	if viper.GetString("discourse.api.key") != "" {
+		options = append(options, auth.WithDiscourseAPI(discourse.NewAPIClient(
+			dsettings.Server,
+			viper.GetString("discourse.api.key"),
+			viper.GetString("discourse.api.username"),
+		)))
+	}
+	if viper.GetBool("oidc.logout.discourse") {
+		if viper.GetString("discourse.api.key") == "" {
+			log.Fatal().Msg("logging out of discourse requires the discourse api to be configured")
+		}
+		options = append(options, auth.WithDiscourseLogout(true))
+	}
+	if viper.GetBool("oidc.refresh.discourse") {
+		if viper.GetString("discourse.api.key") == "" {
+			log.Fatal().Msg("syncing users with discourse requires the discourse api to be configured")
+		}
+		options = append(options, auth.WithDiscourseResync(true))
+	}
+	if viper.GetBool("oidc.prompt.discourse") {
+		options = append(options, auth.WithDiscoursePromptNone(true))
+	}
+	if lifetime := viper.GetDuration("oidc.sso.lifetime"); lifetime != 0 {
+		if lifetime < 0 {
+			log.Fatal().Msg("the sso session lifetime can not be negative")
+		}
+		options = append(options, auth.WithSSOSession(lifetime))
+	}
+	pkce := auth.PKCEPolicy(viper.GetString("oidc.pkce"))
+	if err := pkce.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid oidc configuration")
+	}
+	options = append(options, auth.WithPKCE(pkce))
+	claims := auth.ClaimMappings{}
+	if err := viper.UnmarshalKey("claims", &claims); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse claims")
+	}
+	if err := claims.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid claims configuration")
+	}
+	options = append(options, auth.WithClaims(claims))
+	roles := auth.RoleMappings{}
+	if err := viper.UnmarshalKey("roles", &roles); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse roles")
+	}
+	options = append(options, auth.WithRoles(roles))
+	lifespans := auth.Lifespans{}
+	if err := viper.UnmarshalKey("oidc.lifespans", &lifespans); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse lifespans")
+	}
+	options = append(options, auth.WithLifespans(lifespans))
+	if viper.GetBool("registration.open") || len(viper.GetStringSlice("registration.initialAccessTokens")) != 0 {
+		if viper.GetBool("registration.open") {
+			log.Warn().Msg("client registration is open, anyone can register clients")
+		}
+		options = append(options, auth.WithRegistration(viper.GetBool("registration.open"), viper.GetStringSlice("registration.initialAccessTokens")))
+	}
+	if viper.GetBool("audit.enabled") {
+		auditLog, err := audit.Open(viper.GetString("audit.output"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open audit log")
+		}
+		if err := auditLog.TrustProxies(viper.GetStringSlice("audit.trustedProxies")); err != nil {
+			log.Fatal().Err(err).Msg("invalid audit configuration")
+		}
+		options = append(options, auth.WithAudit(auditLog))
+	}
+	store := openStorage(toFositeClients(clients))
+	go purgeExpired(store)
+	oidc, err := auth.NewOIDC("/oauth2", dsettings, store, options...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up oidc provider")
+	}
 	r.Route("/oauth2", oidc.RegisterHandlers)
+	if secret := viper.GetString("discourse.webhook.secret"); secret != "" {
+		r.Post("/discourse/webhook", auth.NewWebhook(oidc, secret).ServeHTTP)
+	}
+
+	if admin := adminAPI(oidc); admin != nil {
+		r.Route("/admin", admin.RegisterHandlers)
+	}
+
+	if fa := forwardAuth(dsettings); fa != nil {
+		r.Route("/forward-auth", fa.RegisterHandlers)
+	}
+
+	serveMetrics(r)
+
+	h := health.New(health.BuildInfo{Version: version, Commit: commit, Date: date})
+	h.AddCheck("storage", oidc.CheckStorage)
+	h.AddCheck("keys", oidc.CheckKeys)
+	if viper.GetBool("health.discourse") {
+		client := &http.Client{Timeout: time.Second * 5}
+		h.AddCheck("discourse", func(ctx context.Context) error {
+			return discourse.CheckStatus(ctx, client, dsettings.Server)
+		})
+	}
+	h.RegisterHandlers(r)
 
 	log.Info().Str("url", "http://"+viper.GetString("listenAddr")).Msg("Starting server")
-	log.Fatal().Err(http.ListenAndServe(viper.GetString("listenAddr"), r))
+	serve(viper.GetString("listenAddr"), r, oidc.Shutdown, shutdownTracing)
+}
+
+func loadConfig() {
+	viper.SetConfigName("distrust")
+	viper.AddConfigPath("/etc/distrust")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Printf("failed to load config file.\n" +
+			"A config file is required to run distrust. It should be located in `/etc/distrust` or the current working directory\n")
+		os.Exit(1)
+	}
+	viper.SetEnvPrefix("distrust")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	lvl, err := zerolog.ParseLevel(viper.GetString("log.level"))
+	if err != nil {
+		log.Fatal().Str("level", viper.GetString("log.level")).Msg("invalid log level")
+	}
+	zerolog.SetGlobalLevel(lvl)
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
 func toFositeClients(clients map[string]clientConfig) map[string]fosite.Client {
 	r := make(map[string]fosite.Client)
 	for k, v := range clients {
+		public := v.Public || v.TokenEndpointAuthMethod == "none"
 
-		hs := []byte(v.Secret)
-
-		_, err := bcrypt.Cost(hs)
-		if err != nil {
-			hs, _ = bcrypt.GenerateFromPassword(hs, bcrypt.DefaultCost)
+		var hs []byte
+		if v.Secret != "" {
+			hs = []byte(v.Secret)
+			_, err := bcrypt.Cost(hs)
+			if err != nil {
+				hs, _ = bcrypt.GenerateFromPassword(hs, bcrypt.DefaultCost)
+			}
 		}
 
-		r[k] = &auth.DistrustClient{
+		client := &auth.DistrustClient{
 			DefaultClient: fosite.DefaultClient{
 				ID:            k,
 				Secret:        hs,
 				RedirectURIs:  v.RedirectURIs,
-				ResponseTypes: []string{"id_token", "code", "token", "id_token token", "code id_token", "code token", "code id_token token"},
-				GrantTypes:    []string{"implicit", "refresh_token", "authorization_code", "password", "client_credentials"},
-				Scopes:        []string{"openid", "profile", "email"},
+				ResponseTypes: orDefault(v.ResponseTypes, defaultResponseTypes),
+				GrantTypes:    orDefault(v.GrantTypes, defaultGrantTypes),
+				Scopes:        orDefault(v.Scopes, defaultScopes),
+				Audience:      v.Audience,
+				Public:        public,
+			},
+			GroupRules: auth.GroupRules{
+				AllowGroups: v.AllowGroups,
+				DenyGroups:  v.DenyGroups,
+				AllowRoles:  v.AllowRoles,
+				DenyRoles:   v.DenyRoles,
 			},
-			AllowGroups: v.AllowGroups,
-			DenyGroups:  v.DenyGroups,
+			PostLogoutRedirectURIs:  v.PostLogoutRedirectURIs,
+			BackchannelLogoutURI:    v.BackchannelLogoutURI,
+			TokenEndpointAuthMethod: v.TokenEndpointAuthMethod,
+			PKCE:                    auth.PKCEPolicy(v.PKCE),
+			Claims:                  v.Claims,
+			Roles:                   v.Roles,
+			Lifespans:               v.Lifespans,
+		}
+		if v.Policy != "" {
+			p, err := policy.Compile(v.Policy)
+			if err != nil {
+				log.Fatal().Err(err).Str("client", k).Msg("invalid client policy")
+			}
+			client.Policy = p
 		}
-		if len(v.AllowGroups) != 0 && len(v.DenyGroups) != 0 {
-			log.Warn().Str("client", k).Msg("allow and deny group options are set. allow groups will be used")
+		if err := client.Validate(); err != nil {
+			log.Fatal().Err(err).Str("client", k).Msg("invalid client configuration")
 		}
+		if len(v.AllowGroups)+len(v.AllowRoles) != 0 && len(v.DenyGroups)+len(v.DenyRoles) != 0 {
+			log.Warn().Str("client", k).Msg("allow and deny options are set. allow groups and roles will be used")
+		}
+		r[k] = client
 	}
 	return r
 }
 
-func parsePrivateKey(raw string) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(raw))
-	if block == nil {
-		return nil, errors.New("no pem block found")
+func orDefault(values, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
+
+// forwardAuth sets up forward auth if any hosts are configured
+func forwardAuth(dsettings discourse.SSOConfig) *auth.ForwardAuth {
+	hosts := []protectedHost{}
+	if err := viper.UnmarshalKey("forwardAuth.hosts", &hosts); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse forward auth hosts")
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	rules := make(map[string]auth.GroupRules, len(hosts))
+	for _, h := range hosts {
+		rules[h.Host] = auth.GroupRules{AllowGroups: h.AllowGroups, DenyGroups: h.DenyGroups}
+	}
+	log.Info().Int("numHosts", len(hosts)).Msg("forward auth enabled")
+	return auth.NewForwardAuth(dsettings, sessionSecret(), rules, sessionLifetime("forwardAuth.sessionLifetime"))
+}
+
+// shutdownTimeout limits how long requests in flight are finished and traces are flushed on shutdown
+const shutdownTimeout = time.Second * 10
+
+// setupTracing exports traces with OTLP if tracing is enabled. The returned function flushes
+// the spans which were not exported yet.
+func setupTracing() func(context.Context) error {
+	if !viper.GetBool("tracing.enabled") {
+		return func(context.Context) error { return nil }
+	}
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Insecure:    viper.GetBool("tracing.insecure"),
+		ServiceName: viper.GetString("tracing.serviceName"),
+		SampleRatio: viper.GetFloat64("tracing.sampleRatio"),
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+	log.Info().Str("endpoint", viper.GetString("tracing.endpoint")).Msg("tracing enabled")
+	return shutdown
+}
+
+// serve serves h on addr until the process is interrupted or terminated. Requests in flight and,
+// if set, the background work waited for by drain are finished before the traces are flushed.
+func serve(addr string, h http.Handler, drain, shutdownTracing func(context.Context) error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: addr, Handler: h}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Info().Msg("shutting down")
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Error().Err(err).Msg("finishing requests")
+		}
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal().Err(err).Msg("server failed")
+	}
+	<-stopped
+
+	if drain != nil {
+		dctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := drain(dctx); err != nil {
+			log.Error().Err(err).Msg("finishing background work")
+		}
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(tctx); err != nil {
+		log.Error().Err(err).Msg("flushing traces")
+	}
+}
+
+// serveMetrics exposes the prometheus metrics on the router or, if configured, on a separate listener
+func serveMetrics(r chi.Router) {
+	if !viper.GetBool("metrics.enabled") {
+		return
+	}
+	addr := viper.GetString("metrics.listenAddr")
+	if addr == "" {
+		r.Handle("/metrics", metrics.Handler())
+		return
+	}
+	log.Info().Str("url", "http://"+addr+"/metrics").Msg("Starting metrics server")
+	go func() {
+		log.Fatal().Err(http.ListenAndServe(addr, metrics.Handler())).Msg("metrics server failed")
+	}()
+}
+
+// adminAPI sets up the admin api if any admin tokens or groups are configured
+func adminAPI(oidc *auth.OIDCProvider) *auth.Admin {
+	tokens := viper.GetStringSlice("admin.tokens")
+	groups := viper.GetStringSlice("admin.groups")
+	if len(tokens) == 0 && len(groups) == 0 {
+		return nil
 	}
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	log.Info().Int("numTokens", len(tokens)).Strs("groups", groups).Msg("admin api enabled")
+	return auth.NewAdmin(oidc, "/admin", sessionSecret(), tokens, groups)
+}
+
+// sessionSecret returns the secret used for encrypting user session cookies
+func sessionSecret() []byte {
+	secret := []byte(viper.GetString("oidc.secret"))
+	if len(secret) == 0 {
+		log.Warn().Msg("no oidc secret configured, user sessions will not survive a restart")
+		secret = make([]byte, 32)
+		_, _ = rand.Read(secret)
+	}
+	return secret
+}
+
+func sessionLifetime(key string) time.Duration {
+	if lifetime := viper.GetDuration(key); lifetime > 0 {
+		return lifetime
+	}
+	return time.Hour * 12
+}
+
+func keySpec() cryptutils.KeySpec {
+	return cryptutils.KeySpec{
+		Type: viper.GetString("oidc.keyType"),
+		Bits: viper.GetInt("oidc.keyBits"),
+	}
+}
+
+func openStorage(clients map[string]fosite.Client) *storage.SQLStore {
+	driver := viper.GetString("storage.driver")
+	if driver == "" || driver == "memory" {
+		log.Warn().Msg("using memory storage. All tokens are lost on restart")
+	}
+	store, err := storage.Open(storage.Config{
+		Driver: driver,
+		DSN:    viper.GetString("storage.dsn"),
+	}, clients)
 	if err != nil {
-		return nil, fmt.Errorf("parsing private key: %w", err)
+		log.Fatal().Err(err).Msg("failed to open storage")
+	}
+	return store
+}
+
+func purgeExpired(store *storage.SQLStore) {
+	for range time.Tick(time.Hour) {
+		n, err := store.DeleteExpired(context.Background(), time.Now())
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to purge expired tokens")
+			continue
+		}
+		log.Debug().Int64("purged", n).Msg("purged expired tokens")
 	}
-	return key, nil
 }
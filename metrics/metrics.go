@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	authorizeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_authorize_requests_total",
+		Help: "Authorize requests by client and result.",
+	}, []string{"client", "result"})
+	callbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_discourse_callbacks_total",
+		Help: "DiscourseConnect callbacks by outcome.",
+	}, []string{"outcome"})
+	tokenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_token_requests_total",
+		Help: "Token requests by grant type, client and result.",
+	}, []string{"grant_type", "client", "result"})
+	introspections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_introspections_total",
+		Help: "Token introspections by result.",
+	}, []string{"result"})
+	revocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_revocations_total",
+		Help: "Token revocations by result.",
+	}, []string{"result"})
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_logins_total",
+		Help: "Logins redirected to discourse and finished by a discourse callback.",
+	}, []string{"stage"})
+	webhooks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "distrust_discourse_webhooks_total",
+		Help: "Verified discourse webhooks by event and result.",
+	}, []string{"event", "result"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "distrust_http_request_duration_seconds",
+		Help:    "Latency of http requests by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Callback outcomes
+const (
+	CallbackSuccess        = "success"
+	CallbackInvalidSession = "invalid_session"
+	CallbackBadSignature   = "bad_signature"
+	CallbackBadNonce       = "bad_nonce"
+	CallbackDenied         = "denied"
+	CallbackLoginRequired  = "login_required"
+	CallbackError          = "error"
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		authorizeRequests,
+		callbacks,
+		tokenRequests,
+		introspections,
+		revocations,
+		logins,
+		webhooks,
+		requestDuration,
+	)
+}
+
+// Handler serves the metrics in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// Middleware records the latency of requests by their chi route pattern
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww, ok := w.(middleware.WrapResponseWriter)
+		if !ok {
+			ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		}
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(ww.Status())).Observe(time.Since(start).Seconds())
+	})
+}
+
+// AuthorizeRequest counts an authorize request of the client
+func AuthorizeRequest(client string, err error) {
+	authorizeRequests.WithLabelValues(client, result(err)).Inc()
+}
+
+// Callback counts a discourse callback with one of the callback outcomes
+func Callback(outcome string) {
+	callbacks.WithLabelValues(outcome).Inc()
+}
+
+// TokenRequest counts a token request of the client
+func TokenRequest(grantType, client string, err error) {
+	tokenRequests.WithLabelValues(grantType, client, result(err)).Inc()
+}
+
+// Introspection counts a token introspection
+func Introspection(active bool, err error) {
+	switch {
+	case err != nil:
+		introspections.WithLabelValues("error").Inc()
+	case active:
+		introspections.WithLabelValues("active").Inc()
+	default:
+		introspections.WithLabelValues("inactive").Inc()
+	}
+}
+
+// Revocation counts a token revocation
+func Revocation(err error) {
+	revocations.WithLabelValues(result(err)).Inc()
+}
+
+// Webhook counts a discourse webhook, which either revoked the tokens of a user or was ignored
+func Webhook(event string, revoked bool) {
+	result := "ignored"
+	if revoked {
+		result = "revoked"
+	}
+	webhooks.WithLabelValues(event, result).Inc()
+}
+
+// LoginStarted counts a login redirected to discourse
+func LoginStarted() {
+	logins.WithLabelValues("started").Inc()
+}
+
+// LoginFinished counts a login returning from discourse. Logins which were started
+// but never finished are the difference to the started logins.
+func LoginFinished() {
+	logins.WithLabelValues("finished").Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLogins(t *testing.T) {
+	started := testutil.ToFloat64(logins.WithLabelValues("started"))
+	finished := testutil.ToFloat64(logins.WithLabelValues("finished"))
+	for i := 0; i < 3; i++ {
+		LoginStarted()
+	}
+	LoginFinished()
+	if got := testutil.ToFloat64(logins.WithLabelValues("started")) - started; got != 3 {
+		t.Errorf("%v logins started, want 3", got)
+	}
+	if got := testutil.ToFloat64(logins.WithLabelValues("finished")) - finished; got != 1 {
+		t.Errorf("%v logins finished, want 1", got)
+	}
+}
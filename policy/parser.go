@@ -0,0 +1,260 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokString
+	tokInt
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of policy"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators are sorted so that longer operators are matched first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		end := strings.IndexByte(l.src[l.pos+1:], c)
+		if end < 0 {
+			return token{}, fmt.Errorf("unterminated string at position %d", start)
+		}
+		l.pos += end + 2
+		return token{kind: tokString, text: l.src[start+1 : l.pos-1], pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		return token{kind: tokInt, text: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at position %d", c, start)
+}
+
+// parser is a recursive descent parser for the grammar
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) operand ]
+//	operand    = string | int | "true" | "false" | identifier | list | "(" or ")"
+//	list       = "[" [ string { "," string } ] "]"
+type parser struct {
+	lexer lexer
+	tok   token
+}
+
+func (p *parser) next() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(format+" at position %d", append(args, p.tok.pos)...)
+}
+
+func (p *parser) is(op string) bool {
+	return (p.tok.kind == tokOp || p.tok.kind == tokIdent) && p.tok.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if !p.is(op) {
+		return p.errorf("expected %q, got %s", op, p.tok)
+	}
+	return p.next()
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogical("&&", p.parseUnary)
+}
+
+func (p *parser) parseLogical(op string, operand func() (node, error)) (node, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	operands := []node{first}
+	for p.is(op) {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, next)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	for _, o := range operands {
+		if o.kind() != kindBool {
+			return nil, fmt.Errorf("%s requires bool operands, got %s", op, o)
+		}
+	}
+	return &logical{op: op, operands: operands}, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if !p.is("!") {
+		return p.parseComparison()
+	}
+	pos := p.tok.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if operand.kind() != kindBool {
+		return nil, fmt.Errorf("! requires a bool operand at position %d", pos)
+	}
+	return &not{operand: operand}, nil
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	var op string
+	for _, o := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.is(o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return left, nil
+	}
+	pos := p.tok.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case op == "in":
+		if left.kind() != kindString || right.kind() != kindList {
+			return nil, fmt.Errorf("in requires a string and a list at position %d", pos)
+		}
+	case left.kind() != right.kind():
+		return nil, fmt.Errorf("can not compare %s with %s at position %d", left.kind(), right.kind(), pos)
+	case left.kind() == kindList:
+		return nil, fmt.Errorf("lists can not be compared at position %d", pos)
+	case op != "==" && op != "!=" && left.kind() == kindBool:
+		return nil, fmt.Errorf("%s can not be used with bools at position %d", op, pos)
+	}
+	return &comparison{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokString:
+		return &literal{value: tok.text, k: kindString}, p.next()
+	case tok.kind == tokInt:
+		i, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+		return &literal{value: i, k: kindInt}, p.next()
+	case tok.kind == tokIdent && (tok.text == "true" || tok.text == "false"):
+		return &literal{value: tok.text == "true", k: kindBool}, p.next()
+	case tok.kind == tokIdent:
+		v, ok := variables[tok.text]
+		if !ok {
+			return nil, p.errorf("unknown identifier %s", tok)
+		}
+		return &ident{name: tok.text, v: v}, p.next()
+	case p.is("["):
+		return p.parseList()
+	case p.is("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+func (p *parser) parseList() (node, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for !p.is("]") {
+		if len(list) != 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		if p.tok.kind != tokString {
+			return nil, p.errorf("lists can only contain strings, got %s", p.tok)
+		}
+		list = append(list, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return &literal{value: list, k: kindList}, p.next()
+}
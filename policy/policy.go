@@ -0,0 +1,246 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Input describes the login a policy is evaluated against
+type Input struct {
+	Username  string
+	Name      string
+	Email     string
+	Groups    []string
+	Roles     []string
+	Admin     bool
+	Moderator bool
+	// Scopes are the scopes requested by the client
+	Scopes []string
+	Time   time.Time
+}
+
+// Policy is a compiled access policy expression
+type Policy struct {
+	source string
+	root   node
+}
+
+// Compile parses and type checks a policy expression. The expression has to evaluate to a bool.
+func Compile(expr string) (*Policy, error) {
+	p := &parser{lexer: lexer{src: expr}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	if root.kind() != kindBool {
+		return nil, fmt.Errorf("policy evaluates to %s instead of bool", root.kind())
+	}
+	return &Policy{source: expr, root: root}, nil
+}
+
+// String returns the source of the policy
+func (p *Policy) String() string {
+	return p.source
+}
+
+// Evaluate decides whether the policy allows the input. The trace lists the result
+// of every evaluated condition in the order of evaluation.
+func (p *Policy) Evaluate(in Input) (bool, []string) {
+	e := &env{input: in}
+	allowed := p.root.eval(e).(bool)
+	return allowed, e.trace
+}
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindBool
+	kindList
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindInt:
+		return "int"
+	case kindBool:
+		return "bool"
+	}
+	return "list"
+}
+
+type variable struct {
+	kind kind
+	get  func(Input) interface{}
+}
+
+// variables are the identifiers available in policies
+var variables = map[string]variable{
+	"username": {kindString, func(in Input) interface{} { return in.Username }},
+	"name":     {kindString, func(in Input) interface{} { return in.Name }},
+	"email":    {kindString, func(in Input) interface{} { return in.Email }},
+	"email_domain": {kindString, func(in Input) interface{} {
+		_, domain, _ := strings.Cut(in.Email, "@")
+		return strings.ToLower(domain)
+	}},
+	"groups":    {kindList, func(in Input) interface{} { return in.Groups }},
+	"roles":     {kindList, func(in Input) interface{} { return in.Roles }},
+	"scopes":    {kindList, func(in Input) interface{} { return in.Scopes }},
+	"admin":     {kindBool, func(in Input) interface{} { return in.Admin }},
+	"moderator": {kindBool, func(in Input) interface{} { return in.Moderator }},
+	"hour":      {kindInt, func(in Input) interface{} { return in.Time.Hour() }},
+	"time":      {kindString, func(in Input) interface{} { return in.Time.Format("15:04") }},
+	"weekday":   {kindString, func(in Input) interface{} { return strings.ToLower(in.Time.Weekday().String()) }},
+}
+
+type env struct {
+	input Input
+	trace []string
+}
+
+func (e *env) record(n node, v interface{}) {
+	e.trace = append(e.trace, fmt.Sprintf("%s => %v", n, v))
+}
+
+type node interface {
+	kind() kind
+	eval(e *env) interface{}
+	String() string
+}
+
+type literal struct {
+	value interface{}
+	k     kind
+}
+
+func (l *literal) kind() kind              { return l.k }
+func (l *literal) eval(e *env) interface{} { return l.value }
+func (l *literal) String() string {
+	switch v := l.value.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return fmt.Sprint(l.value)
+}
+
+type ident struct {
+	name string
+	v    variable
+}
+
+func (i *ident) kind() kind { return i.v.kind }
+func (i *ident) eval(e *env) interface{} {
+	v := i.v.get(e.input)
+	if i.v.kind == kindBool {
+		e.record(i, v)
+	}
+	return v
+}
+func (i *ident) String() string { return i.name }
+
+type not struct {
+	operand node
+}
+
+func (n *not) kind() kind { return kindBool }
+func (n *not) eval(e *env) interface{} {
+	v := !n.operand.eval(e).(bool)
+	e.record(n, v)
+	return v
+}
+func (n *not) String() string {
+	switch n.operand.(type) {
+	case *comparison, *logical:
+		return "!(" + n.operand.String() + ")"
+	}
+	return "!" + n.operand.String()
+}
+
+// logical is a chain of operands joined by the same operator
+type logical struct {
+	op       string
+	operands []node
+}
+
+func (l *logical) kind() kind { return kindBool }
+func (l *logical) eval(e *env) interface{} {
+	var v bool
+	for _, o := range l.operands {
+		v = o.eval(e).(bool)
+		if (l.op == "&&" && !v) || (l.op == "||" && v) {
+			break
+		}
+	}
+	e.record(l, v)
+	return v
+}
+func (l *logical) String() string {
+	parts := make([]string, len(l.operands))
+	for i, o := range l.operands {
+		parts[i] = o.String()
+		if _, ok := o.(*logical); ok {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+l.op+" ")
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (c *comparison) kind() kind { return kindBool }
+func (c *comparison) eval(e *env) interface{} {
+	l, r := c.left.eval(e), c.right.eval(e)
+	var v bool
+	switch c.op {
+	case "in":
+		v = slices.Contains(r.([]string), l.(string))
+	case "==":
+		v = l == r
+	case "!=":
+		v = l != r
+	default:
+		v = compare(c.op, l, r)
+	}
+	e.record(c, v)
+	return v
+}
+func (c *comparison) String() string { return c.left.String() + " " + c.op + " " + c.right.String() }
+
+func compare(op string, l, r interface{}) bool {
+	var cmp int
+	switch l := l.(type) {
+	case int:
+		cmp = l - r.(int)
+	case string:
+		cmp = strings.Compare(l, r.(string))
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLexer(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []string
+		err  string
+	}{
+		{src: `admin && !moderator`, want: []string{"admin", "&&", "!", "moderator"}},
+		{src: `hour>=6||hour<=22`, want: []string{"hour", ">=", "6", "||", "hour", "<=", "22"}},
+		{src: `"team" in ["a", 'b']`, want: []string{"team", "in", "[", "a", ",", "b", "]"}},
+		// there are no escapes, quotes of the other kind and backslashes are kept as they are
+		{src: `'say "hi"'`, want: []string{`say "hi"`}},
+		{src: `"it's"`, want: []string{"it's"}},
+		{src: `"a\b"`, want: []string{`a\b`}},
+		{src: `"a\"`, want: []string{`a\`}},
+		{src: `"unterminated`, err: "unterminated string at position 0"},
+		{src: `"a\" b"`, err: "unterminated string at position 6"},
+		{src: `admin & moderator`, err: "unexpected character '&' at position 6"},
+		{src: `admin | moderator`, err: "unexpected character '|' at position 6"},
+		{src: `email = "a"`, err: "unexpected character '=' at position 6"},
+		{src: `admin @`, err: "unexpected character '@' at position 6"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			l := &lexer{src: tc.src}
+			var got []string
+			for {
+				tok, err := l.next()
+				if err != nil {
+					if tc.err == "" || err.Error() != tc.err {
+						t.Fatalf("got error %q, want %q", err, tc.err)
+					}
+					return
+				}
+				if tok.kind == tokEOF {
+					break
+				}
+				got = append(got, tok.text)
+			}
+			if tc.err != "" {
+				t.Fatalf("got tokens %q, want error %q", got, tc.err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got tokens %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{"", "unexpected end of policy at position 0"},
+		{"hour", "policy evaluates to int instead of bool"},
+		{"groups", "policy evaluates to list instead of bool"},
+		{`"admin"`, "policy evaluates to string instead of bool"},
+		{"unknown", `unknown identifier "unknown" at position 0`},
+		{"admin && isadmin", `unknown identifier "isadmin" at position 9`},
+		{"groups == 1", "can not compare list with int at position 7"},
+		{`hour == "6"`, "can not compare int with string at position 5"},
+		{"groups == roles", "lists can not be compared at position 7"},
+		{"admin < moderator", "< can not be used with bools at position 6"},
+		{`"team" in "teams"`, "in requires a string and a list at position 7"},
+		{"1 in groups", "in requires a string and a list at position 2"},
+		{"groups in groups", "in requires a string and a list at position 7"},
+		{`["a", 1] == groups`, `lists can only contain strings, got "1" at position 6`},
+		{"username && admin", "&& requires bool operands, got username"},
+		{"admin || hour", "|| requires bool operands, got hour"},
+		{"!hour", "! requires a bool operand at position 0"},
+		{"(admin", `expected ")", got end of policy at position 6`},
+		{"admin moderator", `unexpected "moderator" at position 6`},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := Compile(tc.expr)
+			if err == nil {
+				t.Fatalf("compiled, want error %q", tc.err)
+			}
+			if err.Error() != tc.err {
+				t.Errorf("got error %q, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// a tuesday
+	at := time.Date(2024, 5, 7, 21, 30, 0, 0, time.UTC)
+	in := Input{
+		Username: "alice",
+		Name:     "Alice",
+		Email:    "alice@Example.COM",
+		Groups:   []string{"team", "trainers"},
+		Roles:    []string{"editor"},
+		Admin:    false,
+		Scopes:   []string{"openid", "profile"},
+		Time:     at,
+	}
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{`username == "alice"`, true},
+		{`name != "Alice"`, false},
+		{`email == "alice@Example.COM"`, true},
+		{`email_domain == "example.com"`, true},
+		{`"team" in groups`, true},
+		{`"admins" in groups`, false},
+		{`"editor" in roles`, true},
+		{`"offline_access" in scopes`, false},
+		{`username in ["bob", "alice"]`, true},
+		{`hour == 21`, true},
+		{`hour >= 6 && hour < 21`, false},
+		{`time > "21:00" && time <= "21:30"`, true},
+		{`weekday == "tuesday"`, true},
+		{`admin`, false},
+		{`!admin`, true},
+		{`!!admin`, false},
+		{`admin || moderator`, false},
+		// ! binds tighter than &&, which binds tighter than ||
+		{`!admin || moderator && false`, true},
+		{`!(admin || moderator) && false`, false},
+		{`admin && moderator || true`, true},
+		{`admin && (moderator || true)`, false},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!"team" in groups`, false},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			p, err := Compile(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, trace := p.Evaluate(in); got != tc.want {
+				t.Errorf("got %v, want %v, trace %q", got, tc.want, trace)
+			}
+		})
+	}
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	in := Input{
+		Email:  "alice@example.com",
+		Groups: []string{"team"},
+		Scopes: []string{"openid"},
+		Time:   time.Date(2024, 5, 7, 21, 30, 0, 0, time.UTC),
+	}
+	for _, tc := range []struct {
+		expr  string
+		want  bool
+		trace []string
+	}{
+		{
+			expr: `("team" in groups || admin) && email_domain == "example.com" && !("offline_access" in scopes)`,
+			want: true,
+			trace: []string{
+				`"team" in groups => true`,
+				`"team" in groups || admin => true`,
+				`email_domain == "example.com" => true`,
+				`"offline_access" in scopes => false`,
+				`!("offline_access" in scopes) => true`,
+				`("team" in groups || admin) && email_domain == "example.com" && !("offline_access" in scopes) => true`,
+			},
+		},
+		{
+			// && stops at the first false operand
+			expr: `admin && hour < 22`,
+			want: false,
+			trace: []string{
+				"admin => false",
+				"admin && hour < 22 => false",
+			},
+		},
+		{
+			expr: `!admin || moderator && username in ["a", "b"]`,
+			want: true,
+			trace: []string{
+				"admin => false",
+				"!admin => true",
+				`!admin || (moderator && username in ["a", "b"]) => true`,
+			},
+		},
+		{
+			expr: `!(admin || moderator)`,
+			want: true,
+			trace: []string{
+				"admin => false",
+				"moderator => false",
+				"admin || moderator => false",
+				"!(admin || moderator) => true",
+			},
+		},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			p, err := Compile(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.String() != tc.expr {
+				t.Errorf("policy source %q, want %q", p.String(), tc.expr)
+			}
+			got, trace := p.Evaluate(in)
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			if !slices.Equal(trace, tc.trace) {
+				t.Errorf("got trace\n%s\nwant\n%s", strings.Join(trace, "\n"), strings.Join(tc.trace, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parkour-vienna/distrust/auth"
+	"github.com/parkour-vienna/distrust/policy"
+	"github.com/spf13/viper"
+)
+
+// policyTest evaluates a policy against a sample DiscourseConnect payload and prints the decision trace.
+// It exits with status 1 if the policy denies access.
+func policyTest() {
+	if len(os.Args) < 3 || os.Args[2] != "test" {
+		log.Fatal("usage: distrust policy test [--client id | --expr policy] --payload payload")
+	}
+	flags := flag.NewFlagSet("policy test", flag.ExitOnError)
+	client := flags.String("client", "", "evaluate the policy and roles of this client from the config file")
+	expr := flags.String("expr", "", "policy expression to evaluate")
+	payload := flags.String("payload", "", "DiscourseConnect payload, e.g. 'username=alice&groups=team,admins&admin=true'")
+	scopes := flags.String("scopes", "openid", "space separated scopes requested by the client")
+	at := flags.String("time", "", "time of the login in RFC 3339 format (default now)")
+	_ = flags.Parse(os.Args[3:])
+
+	roles := auth.RoleMappings{}
+	if *client != "" {
+		loadConfig()
+		clients := map[string]clientConfig{}
+		if err := viper.UnmarshalKey("clients", &clients); err != nil {
+			log.Fatal(err)
+		}
+		cc, ok := clients[*client]
+		if !ok {
+			log.Fatalf("client %s is not configured", *client)
+		}
+		if err := viper.UnmarshalKey("roles", &roles); err != nil {
+			log.Fatal(err)
+		}
+		for name, r := range cc.Roles {
+			roles[name] = r
+		}
+		if *expr == "" {
+			*expr = cc.Policy
+		}
+	}
+	if *expr == "" {
+		log.Fatal("no policy to evaluate")
+	}
+	p, err := policy.Compile(*expr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	values, err := url.ParseQuery(*payload)
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	if *at != "" {
+		if now, err = time.Parse(time.RFC3339, *at); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	in := auth.PolicyInput(values, roles.Roles(strings.Split(values.Get("groups"), ","), values), strings.Fields(*scopes), now)
+	allowed, trace := p.Evaluate(in)
+	if len(in.Roles) != 0 {
+		fmt.Println("roles:", strings.Join(in.Roles, ", "))
+	}
+	for _, t := range trace {
+		fmt.Println(t)
+	}
+	if !allowed {
+		fmt.Println("denied")
+		os.Exit(1)
+	}
+	fmt.Println("allowed")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/parkour-vienna/distrust/auth"
+	"github.com/parkour-vienna/distrust/discourse"
+	"github.com/parkour-vienna/distrust/requestlog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type proxyRoute struct {
+	Path        string
+	AllowGroups []string
+	DenyGroups  []string
+}
+
+// proxy runs distrust as an authenticating reverse proxy in front of a single upstream
+func proxy() {
+	dsettings := discourse.SSOConfig{
+		Server: viper.GetString("discourse.server"),
+		Secret: viper.GetString("discourse.secret"),
+	}
+	upstream, err := url.Parse(viper.GetString("proxy.upstream"))
+	if err != nil || upstream.Host == "" {
+		log.Fatal().Str("upstream", viper.GetString("proxy.upstream")).Msg("proxy.upstream must be an absolute url")
+	}
+	cfg := []proxyRoute{}
+	if err := viper.UnmarshalKey("proxy.routes", &cfg); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse proxy routes")
+	}
+	routes := make([]auth.ProxyRoute, 0, len(cfg))
+	for _, r := range cfg {
+		routes = append(routes, auth.ProxyRoute{
+			Path:       r.Path,
+			GroupRules: auth.GroupRules{AllowGroups: r.AllowGroups, DenyGroups: r.DenyGroups},
+		})
+	}
+
+	shutdownTracing := setupTracing()
+	p := auth.NewProxy(dsettings, sessionSecret(), upstream, routes, sessionLifetime("proxy.sessionLifetime"))
+	addr := viper.GetString("proxy.listenAddr")
+	if addr == "" {
+		addr = viper.GetString("listenAddr")
+	}
+	log.Info().Str("url", "http://"+addr).Str("upstream", upstream.String()).Int("numRoutes", len(routes)).Msg("Starting proxy")
+	serve(addr, requestlog.Zerologger(p), nil, shutdownTracing)
+}
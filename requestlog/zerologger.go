@@ -4,22 +4,49 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/parkour-vienna/distrust/tracing"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Zerologger logs finished requests and traces them in a server span, continuing the trace of the caller
 func Zerologger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)),
+		)
+		r = r.WithContext(ctx)
 		defer func() {
-			log.Trace().
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+				span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(ww.Status()))
+			if ww.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+			}
+			span.End()
+
+			event := log.Trace().
 				Str("method", r.Method).
 				Str("path", r.URL.Path).
 				Str("from", r.RemoteAddr).
 				Dur("duration", time.Since(start)).
-				Int("status", ww.Status()).
-				Msg("request finished")
+				Int("status", ww.Status())
+			if sc := span.SpanContext(); sc.IsValid() {
+				event = event.Str("trace_id", sc.TraceID().String())
+			}
+			event.Msg("request finished")
 		}()
 		next.ServeHTTP(ww, r)
 	})
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ory/fosite"
+	"github.com/parkour-vienna/distrust/auth"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+func rotatekeys() {
+	if driver := viper.GetString("storage.driver"); driver == "" || driver == "memory" {
+		log.Fatal().Msg("keys can only be rotated when using a persistent storage")
+	}
+	if viper.GetString("oidc.secret") == "" {
+		log.Fatal().Msg("keys can only be rotated when an oidc secret is configured")
+	}
+	store := openStorage(map[string]fosite.Client{})
+	defer store.Close()
+
+	keys := auth.NewKeySet(store, []byte(viper.GetString("oidc.secret")), keySpec(), 0)
+	if err := keys.Rotate(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("failed to rotate signing keys")
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ory/fosite"
+)
+
+// RegisteredClient is a client which was registered at runtime instead of being configured.
+// Data holds the client metadata in a format defined by the oidc provider.
+type RegisteredClient struct {
+	ID                    string
+	SecretHash            string
+	Data                  string
+	RegistrationTokenHash string
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+}
+
+// ClientDecoder turns a registered client into the client used by fosite
+type ClientDecoder func(client *RegisteredClient) (fosite.Client, error)
+
+type ClientStorage interface {
+	SetClientDecoder(decode ClientDecoder)
+	ConfiguredClients(ctx context.Context) []fosite.Client
+	ListRegisteredClients(ctx context.Context) ([]RegisteredClient, error)
+	GetRegisteredClient(ctx context.Context, id string) (*RegisteredClient, error)
+	CreateRegisteredClient(ctx context.Context, client RegisteredClient) error
+	UpdateRegisteredClient(ctx context.Context, client RegisteredClient) error
+	DeleteRegisteredClient(ctx context.Context, id string) error
+}
+
+// SetClientDecoder enables the lookup of registered clients in GetClient
+func (s *SQLStore) SetClientDecoder(decode ClientDecoder) {
+	s.decodeClient = decode
+}
+
+// ConfiguredClients returns the clients passed to Open, sorted by id
+func (s *SQLStore) ConfiguredClients(_ context.Context) []fosite.Client {
+	clients := make([]fosite.Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].GetID() < clients[j].GetID() })
+	return clients
+}
+
+const clientColumns = "id, secret_hash, data, registration_token_hash, created_at, updated_at"
+
+func (s *SQLStore) ListRegisteredClients(ctx context.Context) ([]RegisteredClient, error) {
+	rows, err := s.query(ctx, "SELECT "+clientColumns+" FROM clients ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []RegisteredClient{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *c)
+	}
+	return clients, rows.Err()
+}
+
+func (s *SQLStore) GetRegisteredClient(ctx context.Context, id string) (*RegisteredClient, error) {
+	c, err := scanClient(s.queryRow(ctx, "SELECT "+clientColumns+" FROM clients WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fosite.ErrNotFound
+	}
+	return c, err
+}
+
+func (s *SQLStore) CreateRegisteredClient(ctx context.Context, client RegisteredClient) error {
+	_, err := s.exec(ctx, "INSERT INTO clients ("+clientColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		client.ID, client.SecretHash, client.Data, client.RegistrationTokenHash, client.CreatedAt.Unix(), client.UpdatedAt.Unix())
+	return err
+}
+
+func (s *SQLStore) UpdateRegisteredClient(ctx context.Context, client RegisteredClient) error {
+	res, err := s.exec(ctx, "UPDATE clients SET secret_hash = ?, data = ?, registration_token_hash = ?, updated_at = ? WHERE id = ?",
+		client.SecretHash, client.Data, client.RegistrationTokenHash, client.UpdatedAt.Unix(), client.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteRegisteredClient(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, "DELETE FROM clients WHERE id = ?", id)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClient(row scanner) (*RegisteredClient, error) {
+	var c RegisteredClient
+	var created, updated int64
+	if err := row.Scan(&c.ID, &c.SecretHash, &c.Data, &c.RegistrationTokenHash, &created, &updated); err != nil {
+		return nil, err
+	}
+	c.CreatedAt = unixTime(created)
+	c.UpdatedAt = unixTime(updated)
+	return &c, nil
+}
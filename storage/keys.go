@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	KeyStateNext    = "next"
+	KeyStateActive  = "active"
+	KeyStateRetired = "retired"
+)
+
+// SigningKey is a private key used to sign tokens. The key itself is stored
+// sealed, the storage never sees the plain private key.
+type SigningKey struct {
+	ID          string
+	SealedKey   string
+	State       string
+	CreatedAt   time.Time
+	ActivatedAt time.Time
+	RetireAt    time.Time
+	// Imported is set for keys which were configured instead of generated
+	Imported bool
+}
+
+type KeyStorage interface {
+	ListSigningKeys(ctx context.Context) ([]SigningKey, error)
+	CreateSigningKey(ctx context.Context, key SigningKey) error
+	UpdateSigningKey(ctx context.Context, key SigningKey) error
+	DeleteSigningKey(ctx context.Context, id string) error
+}
+
+func (s *SQLStore) ListSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	rows, err := s.query(ctx, "SELECT id, sealed_key, state, created_at, activated_at, retire_at, imported FROM signing_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []SigningKey{}
+	for rows.Next() {
+		var k SigningKey
+		var created, activated, retire int64
+		if err := rows.Scan(&k.ID, &k.SealedKey, &k.State, &created, &activated, &retire, &k.Imported); err != nil {
+			return nil, err
+		}
+		k.CreatedAt = unixTime(created)
+		k.ActivatedAt = unixTime(activated)
+		k.RetireAt = unixTime(retire)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) CreateSigningKey(ctx context.Context, key SigningKey) error {
+	_, err := s.exec(ctx, "INSERT INTO signing_keys (id, sealed_key, state, created_at, activated_at, retire_at, imported) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		key.ID, key.SealedKey, key.State, key.CreatedAt.Unix(), unixOrZero(key.ActivatedAt), unixOrZero(key.RetireAt), key.Imported)
+	return err
+}
+
+func (s *SQLStore) UpdateSigningKey(ctx context.Context, key SigningKey) error {
+	_, err := s.exec(ctx, "UPDATE signing_keys SET sealed_key = ?, state = ?, activated_at = ?, retire_at = ? WHERE id = ?",
+		key.SealedKey, key.State, unixOrZero(key.ActivatedAt), unixOrZero(key.RetireAt), key.ID)
+	return err
+}
+
+func (s *SQLStore) DeleteSigningKey(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, "DELETE FROM signing_keys WHERE id = ?", id)
+	return err
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func unixTime(u int64) time.Time {
+	if u == 0 {
+		return time.Time{}
+	}
+	return time.Unix(u, 0).UTC()
+}
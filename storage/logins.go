@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// Login records that a subject signed into a client, so the client can be notified when the subject logs out
+type Login struct {
+	SessionID string
+	ClientID  string
+	Subject   string
+	Issuer    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// Payload is the DiscourseConnect payload of the login
+	Payload url.Values
+}
+
+type LoginStorage interface {
+	CreateLogin(ctx context.Context, login Login) error
+	ListLogins(ctx context.Context, subject string) ([]Login, error)
+	DeleteLogins(ctx context.Context, subject string) error
+}
+
+func (s *SQLStore) CreateLogin(ctx context.Context, login Login) error {
+	_, err := s.exec(ctx, `INSERT INTO logins (session_id, client_id, subject, issuer, created_at, expires_at, payload) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (session_id, client_id) DO UPDATE SET expires_at = excluded.expires_at, payload = excluded.payload`,
+		login.SessionID, login.ClientID, login.Subject, login.Issuer, login.CreatedAt.Unix(), login.ExpiresAt.Unix(), login.Payload.Encode())
+	return err
+}
+
+func (s *SQLStore) ListLogins(ctx context.Context, subject string) ([]Login, error) {
+	rows, err := s.query(ctx, "SELECT session_id, client_id, subject, issuer, created_at, expires_at, payload FROM logins WHERE subject = ? AND expires_at >= ?", subject, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logins := []Login{}
+	for rows.Next() {
+		var l Login
+		var created, expires int64
+		var payload string
+		if err := rows.Scan(&l.SessionID, &l.ClientID, &l.Subject, &l.Issuer, &created, &expires, &payload); err != nil {
+			return nil, err
+		}
+		l.CreatedAt = unixTime(created)
+		l.ExpiresAt = unixTime(expires)
+		l.Payload, _ = url.ParseQuery(payload)
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
+
+func (s *SQLStore) DeleteLogins(ctx context.Context, subject string) error {
+	_, err := s.exec(ctx, "DELETE FROM logins WHERE subject = ?", subject)
+	return err
+}
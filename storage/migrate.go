@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the postgres advisory lock held while migrating, so instances started
+// at the same time do not apply the same migrations concurrently
+const migrationLock = 0x64697374
+
+// migrate applies all migrations in the migrations folder which have not been applied yet.
+// Migrations are named NNNN_description.sql and applied in order of their number.
+func (s *SQLStore) migrate(ctx context.Context) error {
+	if s.dialect == dialectPostgres {
+		// advisory locks belong to the session, so they are taken and released on the same connection
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+			return fmt.Errorf("locking migrations: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLock); err != nil {
+				log.Error().Err(err).Msg("unlocking migrations")
+			}
+		}()
+	}
+
+	_, err := s.exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating migration table: %w", err)
+	}
+
+	applied := map[int]bool{}
+	rows, err := s.query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("listing applied migrations: %w", err)
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		name := strings.TrimPrefix(f, "migrations/")
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("invalid migration name %s: %w", name, err)
+		}
+		if applied[version] {
+			continue
+		}
+		raw, err := migrations.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := s.applyMigration(ctx, version, string(raw)); err != nil {
+			return fmt.Errorf("applying migration %s: %w", name, err)
+		}
+		log.Info().Str("migration", name).Msg("applied database migration")
+	}
+	return nil
+}
+
+func (s *SQLStore) applyMigration(ctx context.Context, version int, raw string) (err error) {
+	ctx, err = s.BeginTX(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = s.Rollback(ctx)
+		}
+	}()
+	for _, stmt := range strings.Split(raw, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err = s.exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err = s.exec(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return s.Commit(ctx)
+}
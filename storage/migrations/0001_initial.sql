@@ -0,0 +1,27 @@
+CREATE TABLE oauth2_requests (
+	kind TEXT NOT NULL,
+	signature TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	requested_at BIGINT NOT NULL,
+	client_id TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	granted_scopes TEXT NOT NULL,
+	audience TEXT NOT NULL,
+	granted_audience TEXT NOT NULL,
+	form TEXT NOT NULL,
+	session TEXT NOT NULL,
+	active BOOLEAN NOT NULL,
+	access_signature TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	PRIMARY KEY (kind, signature)
+);
+
+CREATE INDEX oauth2_requests_request_id ON oauth2_requests (request_id);
+
+CREATE INDEX oauth2_requests_subject ON oauth2_requests (subject);
+
+CREATE TABLE oauth2_jtis (
+	jti TEXT NOT NULL PRIMARY KEY,
+	expires_at BIGINT NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE signing_keys (
+	id TEXT NOT NULL PRIMARY KEY,
+	sealed_key TEXT NOT NULL,
+	state TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	activated_at BIGINT NOT NULL,
+	retire_at BIGINT NOT NULL
+);
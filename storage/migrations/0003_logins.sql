@@ -0,0 +1,11 @@
+CREATE TABLE logins (
+	session_id TEXT NOT NULL,
+	client_id TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	issuer TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	PRIMARY KEY (session_id, client_id)
+);
+
+CREATE INDEX logins_subject ON logins (subject);
@@ -0,0 +1,10 @@
+CREATE TABLE clients (
+	id TEXT PRIMARY KEY,
+	secret_hash TEXT NOT NULL,
+	data TEXT NOT NULL,
+	registration_token_hash TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX oauth2_requests_client_id ON oauth2_requests (client_id);
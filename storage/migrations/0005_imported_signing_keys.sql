@@ -0,0 +1 @@
+ALTER TABLE signing_keys ADD COLUMN imported BOOLEAN NOT NULL DEFAULT FALSE;
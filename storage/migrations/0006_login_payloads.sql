@@ -0,0 +1 @@
+ALTER TABLE logins ADD COLUMN payload TEXT NOT NULL DEFAULT '';
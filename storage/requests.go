@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+)
+
+type requestKind string
+
+const (
+	kindAuthorizeCode requestKind = "code"
+	kindAccessToken   requestKind = "access"
+	kindRefreshToken  requestKind = "refresh"
+	kindOpenID        requestKind = "oidc"
+	kindPKCE          requestKind = "pkce"
+)
+
+// tokenTypes maps stored requests to the token type whose expiry determines
+// when the row can be purged
+var tokenTypes = map[requestKind]fosite.TokenType{
+	kindAuthorizeCode: fosite.AuthorizeCode,
+	kindAccessToken:   fosite.AccessToken,
+	kindRefreshToken:  fosite.RefreshToken,
+	kindOpenID:        fosite.AuthorizeCode,
+	kindPKCE:          fosite.AuthorizeCode,
+}
+
+const requestColumns = "request_id, requested_at, client_id, scopes, granted_scopes, audience, granted_audience, form, session, active"
+
+func (s *SQLStore) createRequest(ctx context.Context, kind requestKind, signature, accessSignature string, req fosite.Requester) error {
+	session, err := json.Marshal(req.GetSession())
+	if err != nil {
+		return fmt.Errorf("serializing session: %w", err)
+	}
+	scopes, _ := json.Marshal(req.GetRequestedScopes())
+	grantedScopes, _ := json.Marshal(req.GetGrantedScopes())
+	audience, _ := json.Marshal(req.GetRequestedAudience())
+	grantedAudience, _ := json.Marshal(req.GetGrantedAudience())
+	form, _ := json.Marshal(req.GetRequestForm())
+
+	var subject string
+	var expiresAt int64
+	if sess := req.GetSession(); sess != nil {
+		subject = sess.GetSubject()
+		if exp := sess.GetExpiresAt(tokenTypes[kind]); !exp.IsZero() {
+			expiresAt = exp.Unix()
+		}
+	}
+
+	_, err = s.exec(ctx, `INSERT INTO oauth2_requests
+		(kind, signature, access_signature, subject, expires_at, `+requestColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		kind, signature, accessSignature, subject, expiresAt,
+		req.GetID(), req.GetRequestedAt().Unix(), req.GetClient().GetID(),
+		string(scopes), string(grantedScopes), string(audience), string(grantedAudience),
+		string(form), string(session), true,
+	)
+	return err
+}
+
+// getRequest loads a stored request and hydrates the given session with the stored session data.
+// Inactive requests are returned together with errInactive.
+func (s *SQLStore) getRequest(ctx context.Context, kind requestKind, signature string, session fosite.Session, errInactive error) (fosite.Requester, error) {
+	var (
+		id, clientID                                     string
+		requestedAt                                      int64
+		scopes, grantedScopes, audience, grantedAudience string
+		form, rawSession                                 string
+		active                                           bool
+	)
+	err := s.queryRow(ctx, "SELECT "+requestColumns+" FROM oauth2_requests WHERE kind = ? AND signature = ?", kind, signature).
+		Scan(&id, &requestedAt, &clientID, &scopes, &grantedScopes, &audience, &grantedAudience, &form, &rawSession, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fosite.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("loading client %s: %w", clientID, err)
+	}
+	if session == nil {
+		session = &openid.DefaultSession{}
+	}
+	if err := json.Unmarshal([]byte(rawSession), session); err != nil {
+		return nil, fmt.Errorf("deserializing session: %w", err)
+	}
+
+	req := &fosite.Request{
+		ID:          id,
+		RequestedAt: time.Unix(requestedAt, 0).UTC(),
+		Client:      client,
+		Session:     session,
+		Form:        url.Values{},
+	}
+	_ = json.Unmarshal([]byte(scopes), &req.RequestedScope)
+	_ = json.Unmarshal([]byte(grantedScopes), &req.GrantedScope)
+	_ = json.Unmarshal([]byte(audience), &req.RequestedAudience)
+	_ = json.Unmarshal([]byte(grantedAudience), &req.GrantedAudience)
+	_ = json.Unmarshal([]byte(form), &req.Form)
+
+	if !active && errInactive != nil {
+		return req, errInactive
+	}
+	return req, nil
+}
+
+func (s *SQLStore) deleteRequest(ctx context.Context, kind requestKind, signature string) error {
+	_, err := s.exec(ctx, "DELETE FROM oauth2_requests WHERE kind = ? AND signature = ?", kind, signature)
+	return err
+}
+
+// GetClient returns a configured client or, if a client decoder is set, a registered client
+func (s *SQLStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	if cl, ok := s.clients[id]; ok {
+		return cl, nil
+	}
+	if s.decodeClient == nil {
+		return nil, fosite.ErrNotFound
+	}
+	rc, err := s.GetRegisteredClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeClient(rc)
+}
+
+func (s *SQLStore) ClientAssertionJWTValid(ctx context.Context, jti string) error {
+	var exp int64
+	err := s.queryRow(ctx, "SELECT expires_at FROM oauth2_jtis WHERE jti = ?", jti).Scan(&exp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if time.Unix(exp, 0).After(time.Now()) {
+		return fosite.ErrJTIKnown
+	}
+	return nil
+}
+
+func (s *SQLStore) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
+	if _, err := s.exec(ctx, "DELETE FROM oauth2_jtis WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		return err
+	}
+	res, err := s.exec(ctx, "INSERT INTO oauth2_jtis (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING", jti, exp.Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fosite.ErrJTIKnown
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateAuthorizeCodeSession(ctx context.Context, code string, req fosite.Requester) error {
+	return s.createRequest(ctx, kindAuthorizeCode, code, "", req)
+}
+
+func (s *SQLStore) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	return s.getRequest(ctx, kindAuthorizeCode, code, session, fosite.ErrInvalidatedAuthorizeCode)
+}
+
+func (s *SQLStore) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	res, err := s.exec(ctx, "UPDATE oauth2_requests SET active = ? WHERE kind = ? AND signature = ?", false, kindAuthorizeCode, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateAccessTokenSession(ctx context.Context, signature string, req fosite.Requester) error {
+	return s.createRequest(ctx, kindAccessToken, signature, "", req)
+}
+
+func (s *SQLStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	return s.getRequest(ctx, kindAccessToken, signature, session, nil)
+}
+
+func (s *SQLStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	return s.deleteRequest(ctx, kindAccessToken, signature)
+}
+
+func (s *SQLStore) CreateRefreshTokenSession(ctx context.Context, signature, accessSignature string, req fosite.Requester) error {
+	return s.createRequest(ctx, kindRefreshToken, signature, accessSignature, req)
+}
+
+func (s *SQLStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	return s.getRequest(ctx, kindRefreshToken, signature, session, fosite.ErrInactiveToken)
+}
+
+func (s *SQLStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	return s.deleteRequest(ctx, kindRefreshToken, signature)
+}
+
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, requestID string, refreshTokenSignature string) error {
+	if err := s.RevokeRefreshToken(ctx, requestID); err != nil {
+		return err
+	}
+	return s.RevokeAccessToken(ctx, requestID)
+}
+
+func (s *SQLStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	_, err := s.exec(ctx, "UPDATE oauth2_requests SET active = ? WHERE kind = ? AND request_id = ?", false, kindRefreshToken, requestID)
+	return err
+}
+
+func (s *SQLStore) RevokeAccessToken(ctx context.Context, requestID string) error {
+	_, err := s.exec(ctx, "DELETE FROM oauth2_requests WHERE kind = ? AND request_id = ?", kindAccessToken, requestID)
+	return err
+}
+
+func (s *SQLStore) CreateOpenIDConnectSession(ctx context.Context, authorizeCode string, req fosite.Requester) error {
+	return s.createRequest(ctx, kindOpenID, authorizeCode, "", req)
+}
+
+func (s *SQLStore) GetOpenIDConnectSession(ctx context.Context, authorizeCode string, req fosite.Requester) (fosite.Requester, error) {
+	return s.getRequest(ctx, kindOpenID, authorizeCode, req.GetSession(), nil)
+}
+
+func (s *SQLStore) DeleteOpenIDConnectSession(ctx context.Context, authorizeCode string) error {
+	return s.deleteRequest(ctx, kindOpenID, authorizeCode)
+}
+
+func (s *SQLStore) CreatePKCERequestSession(ctx context.Context, signature string, req fosite.Requester) error {
+	return s.createRequest(ctx, kindPKCE, signature, "", req)
+}
+
+func (s *SQLStore) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	return s.getRequest(ctx, kindPKCE, signature, session, nil)
+}
+
+func (s *SQLStore) DeletePKCERequestSession(ctx context.Context, signature string) error {
+	return s.deleteRequest(ctx, kindPKCE, signature)
+}
+
+// Authenticate is required by the resource owner password grant. Distrust only
+// authenticates users through discourse, so no credentials are ever valid here.
+func (s *SQLStore) Authenticate(_ context.Context, name string, secret string) (string, error) {
+	return "", fosite.ErrNotFound.WithDebug("password authentication is not supported")
+}
+
+// DeleteExpired removes all stored requests, jtis and logins which expired before the given time
+func (s *SQLStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.exec(ctx, "DELETE FROM oauth2_requests WHERE expires_at > 0 AND expires_at < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if _, err := s.exec(ctx, "DELETE FROM oauth2_jtis WHERE expires_at < ?", before.Unix()); err != nil {
+		return n, err
+	}
+	if _, err := s.exec(ctx, "DELETE FROM logins WHERE expires_at < ?", before.Unix()); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// RevokeSubject revokes all authorization codes, access tokens and refresh tokens issued to the given subject
+func (s *SQLStore) RevokeSubject(ctx context.Context, subject string) error {
+	if _, err := s.exec(ctx, "DELETE FROM oauth2_requests WHERE kind = ? AND subject = ?", kindAccessToken, subject); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, "UPDATE oauth2_requests SET active = ? WHERE kind IN (?, ?) AND subject = ?", false, kindRefreshToken, kindAuthorizeCode, subject)
+	return err
+}
+
+// TokenInfo describes an issued token without revealing the token itself
+type TokenInfo struct {
+	RequestID   string
+	ClientID    string
+	Subject     string
+	Scopes      []string
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+	Active      bool
+}
+
+// ListRefreshTokens returns all refresh tokens issued to the given subject which have not expired yet
+func (s *SQLStore) ListRefreshTokens(ctx context.Context, subject string) ([]TokenInfo, error) {
+	rows, err := s.query(ctx, `SELECT request_id, client_id, subject, granted_scopes, requested_at, expires_at, active
+		FROM oauth2_requests WHERE kind = ? AND subject = ? AND (expires_at = 0 OR expires_at >= ?) ORDER BY requested_at`,
+		kindRefreshToken, subject, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []TokenInfo{}
+	for rows.Next() {
+		var t TokenInfo
+		var scopes string
+		var requested, expires int64
+		if err := rows.Scan(&t.RequestID, &t.ClientID, &t.Subject, &scopes, &requested, &expires, &t.Active); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(scopes), &t.Scopes)
+		t.RequestedAt = unixTime(requested)
+		t.ExpiresAt = unixTime(expires)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeClient revokes all authorization codes, access tokens and refresh tokens issued to the given client
+func (s *SQLStore) RevokeClient(ctx context.Context, clientID string) error {
+	if _, err := s.exec(ctx, "DELETE FROM oauth2_requests WHERE kind = ? AND client_id = ?", kindAccessToken, clientID); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, "UPDATE oauth2_requests SET active = ? WHERE kind IN (?, ?) AND client_id = ?", false, kindRefreshToken, kindAuthorizeCode, clientID)
+	return err
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/handler/pkce"
+	"github.com/ory/fosite/handler/rfc7523"
+	_ "modernc.org/sqlite"
+)
+
+// Storage is everything the oidc provider needs to persist
+type Storage interface {
+	fosite.Storage
+	oauth2.CoreStorage
+	oauth2.TokenRevocationStorage
+	oauth2.ResourceOwnerPasswordCredentialsGrantStorage
+	openid.OpenIDConnectRequestStorage
+	pkce.PKCERequestStorage
+	rfc7523.RFC7523KeyStorage
+	KeyStorage
+	TokenStorage
+	LoginStorage
+	ClientStorage
+	Transactional
+	Ping(ctx context.Context) error
+}
+
+// TokenStorage manages issued tokens beyond the needs of fosite
+type TokenStorage interface {
+	RevokeSubject(ctx context.Context, subject string) error
+	RevokeClient(ctx context.Context, clientID string) error
+	ListRefreshTokens(ctx context.Context, subject string) ([]TokenInfo, error)
+}
+
+type Transactional interface {
+	BeginTX(ctx context.Context) (context.Context, error)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+type Config struct {
+	// Driver is one of memory, sqlite or postgres
+	Driver string
+	// DSN is the driver specific data source name
+	DSN string
+}
+
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+type SQLStore struct {
+	db      *sql.DB
+	dialect dialect
+	clients map[string]fosite.Client
+	// decodeClient resolves registered clients, which are unknown if it is not set
+	decodeClient ClientDecoder
+}
+
+var _ Storage = (*SQLStore)(nil)
+
+// Open connects to the configured database and applies all pending migrations.
+// The memory driver is backed by an in-memory sqlite database and does not survive restarts.
+func Open(cfg Config, clients map[string]fosite.Client) (*SQLStore, error) {
+	var (
+		db  *sql.DB
+		d   dialect
+		err error
+	)
+	switch cfg.Driver {
+	case "", "memory":
+		db, err = sql.Open("sqlite", ":memory:")
+		d = dialectSQLite
+	case "sqlite", "sqlite3":
+		if cfg.DSN == "" {
+			return nil, errors.New("sqlite storage requires a dsn")
+		}
+		db, err = sql.Open("sqlite", cfg.DSN)
+		d = dialectSQLite
+	case "postgres", "postgresql", "pgx":
+		if cfg.DSN == "" {
+			return nil, errors.New("postgres storage requires a dsn")
+		}
+		db, err = sql.Open("pgx", cfg.DSN)
+		d = dialectPostgres
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	if d == dialectSQLite {
+		// sqlite only allows a single writer. Using one connection avoids busy errors
+		// and keeps in-memory databases from being recreated per connection
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStore{
+		db:      db,
+		dialect: d,
+		clients: clients,
+	}
+	if err := s.migrate(context.Background()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+	return s, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database is reachable
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// rebind replaces the ? placeholders used throughout this package with the
+// placeholder style of the configured database
+func (s *SQLStore) rebind(query string) string {
+	if s.dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type txKey struct{}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction stored in ctx or the database itself
+func (s *SQLStore) conn(ctx context.Context) execer {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+func (s *SQLStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.conn(ctx).ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return s.conn(ctx).QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return s.conn(ctx).QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) BeginTX(ctx context.Context) (context.Context, error) {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return ctx, errors.New("transaction already in progress")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, txKey{}, tx), nil
+}
+
+func (s *SQLStore) Commit(ctx context.Context) error {
+	tx, ok := ctx.Value(txKey{}).(*sql.Tx)
+	if !ok {
+		return errors.New("no transaction in progress")
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Rollback(ctx context.Context) error {
+	tx, ok := ctx.Value(txKey{}).(*sql.Tx)
+	if !ok {
+		return errors.New("no transaction in progress")
+	}
+	return tx.Rollback()
+}
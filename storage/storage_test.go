@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+)
+
+var testClients = map[string]fosite.Client{
+	"test": &fosite.DefaultClient{ID: "test"},
+}
+
+// openTestStore opens a sqlite store in a temporary file
+func openTestStore(t *testing.T) (*SQLStore, string) {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "distrust.db")
+	s, err := Open(Config{Driver: "sqlite", DSN: dsn}, testClients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s, dsn
+}
+
+// testRequest is a request of the test client for subject, with tokens expiring in an hour
+func testRequest(id, subject string) *fosite.Request {
+	session := &openid.DefaultSession{
+		Subject: subject,
+		Claims:  &jwt.IDTokenClaims{Subject: subject, Extra: map[string]interface{}{"sid": "some-sid"}},
+		Headers: &jwt.Headers{},
+	}
+	exp := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	for _, tt := range []fosite.TokenType{fosite.AuthorizeCode, fosite.AccessToken, fosite.RefreshToken} {
+		session.SetExpiresAt(tt, exp)
+	}
+	return &fosite.Request{
+		ID:                id,
+		RequestedAt:       time.Now().UTC().Truncate(time.Second),
+		Client:            testClients["test"],
+		RequestedScope:    fosite.Arguments{"openid", "offline_access"},
+		GrantedScope:      fosite.Arguments{"openid"},
+		RequestedAudience: fosite.Arguments{},
+		GrantedAudience:   fosite.Arguments{},
+		Form:              url.Values{"nonce": {"some-nonce"}},
+		Session:           session,
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s, dsn := openTestStore(t)
+	var n int
+	if err := s.queryRow(t.Context(), "SELECT COUNT(*) FROM schema_migrations").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := migrations.ReadDir("migrations")
+	if n != len(files) {
+		t.Errorf("%d migrations applied, want %d", n, len(files))
+	}
+	_ = s.Close()
+
+	// reopening skips the applied migrations
+	again, err := Open(Config{Driver: "sqlite", DSN: dsn}, testClients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = again.Close()
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := t.Context()
+	want := testRequest("req-1", "42")
+
+	for _, tc := range []struct {
+		kind   string
+		create func(string, fosite.Requester) error
+		get    func(string, fosite.Session) (fosite.Requester, error)
+		delete func(string) error
+	}{
+		{
+			"authorize code",
+			func(sig string, r fosite.Requester) error { return s.CreateAuthorizeCodeSession(ctx, sig, r) },
+			func(sig string, sess fosite.Session) (fosite.Requester, error) {
+				return s.GetAuthorizeCodeSession(ctx, sig, sess)
+			},
+			nil,
+		},
+		{
+			"access token",
+			func(sig string, r fosite.Requester) error { return s.CreateAccessTokenSession(ctx, sig, r) },
+			func(sig string, sess fosite.Session) (fosite.Requester, error) {
+				return s.GetAccessTokenSession(ctx, sig, sess)
+			},
+			func(sig string) error { return s.DeleteAccessTokenSession(ctx, sig) },
+		},
+		{
+			"refresh token",
+			func(sig string, r fosite.Requester) error {
+				return s.CreateRefreshTokenSession(ctx, sig, "access-sig", r)
+			},
+			func(sig string, sess fosite.Session) (fosite.Requester, error) {
+				return s.GetRefreshTokenSession(ctx, sig, sess)
+			},
+			func(sig string) error { return s.DeleteRefreshTokenSession(ctx, sig) },
+		},
+		{
+			"openid connect",
+			func(sig string, r fosite.Requester) error { return s.CreateOpenIDConnectSession(ctx, sig, r) },
+			func(sig string, sess fosite.Session) (fosite.Requester, error) {
+				return s.GetOpenIDConnectSession(ctx, sig, &fosite.Request{Session: sess})
+			},
+			func(sig string) error { return s.DeleteOpenIDConnectSession(ctx, sig) },
+		},
+		{
+			"pkce",
+			func(sig string, r fosite.Requester) error { return s.CreatePKCERequestSession(ctx, sig, r) },
+			func(sig string, sess fosite.Session) (fosite.Requester, error) {
+				return s.GetPKCERequestSession(ctx, sig, sess)
+			},
+			func(sig string) error { return s.DeletePKCERequestSession(ctx, sig) },
+		},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			sig := "sig-" + tc.kind
+			if err := tc.create(sig, want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tc.get(sig, &openid.DefaultSession{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetID() != want.ID || !got.GetRequestedAt().Equal(want.RequestedAt) || got.GetClient().GetID() != "test" {
+				t.Errorf("got request %s at %s of %s", got.GetID(), got.GetRequestedAt(), got.GetClient().GetID())
+			}
+			if !reflect.DeepEqual(got.GetRequestedScopes(), want.RequestedScope) || !reflect.DeepEqual(got.GetGrantedScopes(), want.GrantedScope) {
+				t.Errorf("got scopes %v granted %v", got.GetRequestedScopes(), got.GetGrantedScopes())
+			}
+			if got.GetRequestForm().Get("nonce") != "some-nonce" {
+				t.Errorf("got form %v", got.GetRequestForm())
+			}
+			session := got.GetSession().(*openid.DefaultSession)
+			if session.Subject != "42" || session.Claims.Extra["sid"] != "some-sid" {
+				t.Errorf("got session %+v", session)
+			}
+			if exp := session.GetExpiresAt(fosite.RefreshToken); !exp.Equal(want.Session.GetExpiresAt(fosite.RefreshToken)) {
+				t.Errorf("session expires at %s", exp)
+			}
+
+			if _, err := tc.get("unknown", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrNotFound) {
+				t.Errorf("unknown signature: got %v", err)
+			}
+			if tc.delete == nil {
+				return
+			}
+			if err := tc.delete(sig); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tc.get(sig, &openid.DefaultSession{}); !errors.Is(err, fosite.ErrNotFound) {
+				t.Errorf("deleted request: got %v", err)
+			}
+		})
+	}
+
+	if err := s.InvalidateAuthorizeCodeSession(ctx, "sig-authorize code"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAuthorizeCodeSession(ctx, "sig-authorize code", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		t.Errorf("invalidated code: got %v", err)
+	}
+	if err := s.InvalidateAuthorizeCodeSession(ctx, "unknown"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("invalidating unknown code: got %v", err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := t.Context()
+	req := testRequest("req-1", "42")
+	if err := s.CreateAccessTokenSession(ctx, "access", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRefreshTokenSession(ctx, "refresh", "access", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RotateRefreshToken(ctx, "req-1", "refresh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAccessTokenSession(ctx, "access", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("access token of the rotated refresh token: got %v", err)
+	}
+	if _, err := s.GetRefreshTokenSession(ctx, "refresh", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrInactiveToken) {
+		t.Errorf("rotated refresh token: got %v", err)
+	}
+}
+
+func TestRevokeSubject(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := t.Context()
+	for _, subject := range []string{"42", "43"} {
+		req := testRequest("req-"+subject, subject)
+		if err := s.CreateAuthorizeCodeSession(ctx, "code-"+subject, req); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateAccessTokenSession(ctx, "access-"+subject, req); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateRefreshTokenSession(ctx, "refresh-"+subject, "access-"+subject, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RevokeSubject(ctx, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAuthorizeCodeSession(ctx, "code-42", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		t.Errorf("code of the revoked subject: got %v", err)
+	}
+	if _, err := s.GetAccessTokenSession(ctx, "access-42", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("access token of the revoked subject: got %v", err)
+	}
+	if _, err := s.GetRefreshTokenSession(ctx, "refresh-42", &openid.DefaultSession{}); !errors.Is(err, fosite.ErrInactiveToken) {
+		t.Errorf("refresh token of the revoked subject: got %v", err)
+	}
+	tokens, err := s.ListRefreshTokens(ctx, "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Active || tokens[0].RequestID != "req-42" || tokens[0].ClientID != "test" {
+		t.Errorf("got refresh tokens %+v", tokens)
+	}
+
+	// other subjects keep their tokens
+	if _, err := s.GetAuthorizeCodeSession(ctx, "code-43", &openid.DefaultSession{}); err != nil {
+		t.Errorf("code of another subject: got %v", err)
+	}
+	if _, err := s.GetAccessTokenSession(ctx, "access-43", &openid.DefaultSession{}); err != nil {
+		t.Errorf("access token of another subject: got %v", err)
+	}
+	if _, err := s.GetRefreshTokenSession(ctx, "refresh-43", &openid.DefaultSession{}); err != nil {
+		t.Errorf("refresh token of another subject: got %v", err)
+	}
+}
+
+func TestLogins(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := t.Context()
+	now := time.Now().UTC().Truncate(time.Second)
+	login := Login{
+		SessionID: "some-sid",
+		ClientID:  "test",
+		Subject:   "42",
+		Issuer:    "https://distrust.example.com/oauth2",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		Payload:   url.Values{"username": {"alice"}},
+	}
+	if err := s.CreateLogin(ctx, login); err != nil {
+		t.Fatal(err)
+	}
+	// logging into the same client again updates the login
+	login.Payload.Set("username", "alice2")
+	if err := s.CreateLogin(ctx, login); err != nil {
+		t.Fatal(err)
+	}
+	expired := login
+	expired.SessionID = "old-sid"
+	expired.ExpiresAt = now.Add(-time.Minute)
+	if err := s.CreateLogin(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	logins, err := s.ListLogins(ctx, "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 || !reflect.DeepEqual(logins[0], login) {
+		t.Errorf("got logins %+v, want %+v", logins, login)
+	}
+	if err := s.DeleteLogins(ctx, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if logins, _ := s.ListLogins(ctx, "42"); len(logins) != 0 {
+		t.Errorf("deleted logins are listed: %+v", logins)
+	}
+}
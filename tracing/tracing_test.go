@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useProvider installs tp as global tracer provider for the duration of the test
+func useProvider(t *testing.T, tp trace.TracerProvider) {
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+}
+
+func TestFail(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	useProvider(t, NewProvider("test", 1, sdktrace.WithSyncer(exp)))
+
+	_, span := Start(context.Background(), "failing")
+	Fail(span, errors.New("boom"))
+	span.End()
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans exported, want 1", len(spans))
+	}
+	if s := spans[0]; s.Status.Code != codes.Error || s.Status.Description != "boom" {
+		t.Errorf("status %v %q, want error boom", s.Status.Code, s.Status.Description)
+	}
+	if events := spans[0].Events; len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("error was not recorded: %v", events)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	useProvider(t, NewProvider("test", 1, sdktrace.WithSyncer(exp)))
+
+	ctx, parent := Start(context.Background(), "parent")
+	carrier := Inject(ctx)
+	parent.End()
+
+	sc := Extract(context.Background(), carrier)
+	if !sc.IsRemote() || sc.TraceID() != parent.SpanContext().TraceID() || sc.SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("extracted %v, want the context of %v", sc, parent.SpanContext())
+	}
+	_, child := Start(trace.ContextWithRemoteSpanContext(context.Background(), sc), "child")
+	child.End()
+	if spans := exp.GetSpans(); len(spans) != 2 || spans[1].Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("child span is not linked to the parent: %v", spans)
+	}
+
+	if sc := Extract(context.Background(), map[string]string{}); sc.IsValid() {
+		t.Errorf("extracted %v from an empty carrier", sc)
+	}
+}
+
+func TestParentBasedSampling(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	useProvider(t, NewProvider("test", 0, sdktrace.WithSyncer(exp)))
+
+	_, root := Start(context.Background(), "root")
+	root.End()
+	if root.SpanContext().IsSampled() {
+		t.Error("new trace sampled with ratio 0")
+	}
+
+	sampled := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	_, child := Start(trace.ContextWithRemoteSpanContext(context.Background(), sampled), "child")
+	child.End()
+	if !child.SpanContext().IsSampled() {
+		t.Error("sampling decision of the parent was ignored")
+	}
+	if spans := exp.GetSpans(); len(spans) != 1 || spans[0].Name != "child" {
+		t.Errorf("exported %v, want only the child", spans)
+	}
+}
+
+// recordingExporter keeps the exported spans after shutdown, unlike tracetest.InMemoryExporter
+type recordingExporter struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (e *recordingExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		e.names = append(e.names, s.Name())
+	}
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func (e *recordingExporter) exported() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.names...)
+}
+
+func TestShutdownFlushes(t *testing.T) {
+	exp := &recordingExporter{}
+	tp := NewProvider("test", 1, sdktrace.WithBatcher(exp, sdktrace.WithBatchTimeout(time.Hour)))
+	useProvider(t, tp)
+
+	_, span := Start(context.Background(), "pending")
+	span.End()
+	if spans := exp.exported(); len(spans) != 0 {
+		t.Fatalf("%v exported before shutdown", spans)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if spans := exp.exported(); len(spans) != 1 || spans[0] != "pending" {
+		t.Errorf("exported %v after shutdown, want the pending span", spans)
+	}
+}